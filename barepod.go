@@ -0,0 +1,127 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	corev1typed "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// serviceAccountMountPath is where the ServiceAccount admission controller
+// mounts the token of the service account into the containers.
+const serviceAccountMountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// isBarePod reports whether the pod has no controller that would create a
+// replacement for it once it's deleted.
+func isBarePod(p *corev1.Pod) bool {
+	return metav1.GetControllerOf(p) == nil
+}
+
+// recreatePod waits for the deleted pod to finish terminating so its name is
+// free, and creates it again from the spec it was captured with.
+func recreatePod(core corev1typed.CoreV1Interface, p *corev1.Pod) error {
+	grace := int64(corev1.DefaultTerminationGracePeriodSeconds)
+	if p.Spec.TerminationGracePeriodSeconds != nil {
+		grace = *p.Spec.TerminationGracePeriodSeconds
+	}
+	timeout := time.Duration(grace)*time.Second + time.Second*30
+
+	logEvent("waiting_pod_termination").pod(p.Namespace, p.Name).info()
+	err := wait.PollImmediate(time.Second, timeout, func() (bool, error) {
+		cur, err := core.Pods(p.Namespace).Get(p.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		// a pod with a different UID means the name is already reused.
+		return cur.UID != p.UID, nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed waiting for pod %s/%s to terminate", p.Namespace, p.Name)
+	}
+
+	logEvent("recreating_pod").pod(p.Namespace, p.Name).info()
+	if _, err := core.Pods(p.Namespace).Create(podForRecreation(p)); err != nil {
+		return errors.Wrapf(err, "failed to recreate pod %s/%s", p.Namespace, p.Name)
+	}
+	logEvent("recreated_pod").pod(p.Namespace, p.Name).info()
+	return nil
+}
+
+// podForRecreation returns a copy of the pod without the status, node binding
+// and other fields populated by the server, so that it can be created again.
+func podForRecreation(p *corev1.Pod) *corev1.Pod {
+	out := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            p.Name,
+			Namespace:       p.Namespace,
+			Labels:          p.Labels,
+			Annotations:     p.Annotations,
+			OwnerReferences: p.OwnerReferences,
+		},
+		Spec: *p.Spec.DeepCopy(),
+	}
+	out.Spec.NodeName = ""
+	// priority is resolved from the PriorityClassName by the admission
+	// controller, which rejects pods that set it explicitly.
+	out.Spec.Priority = nil
+	stripServiceAccountToken(&out.Spec)
+	return out
+}
+
+// stripServiceAccountToken removes the service account token volume and its
+// mounts injected by the admission controller, which injects them again for
+// the new pod.
+func stripServiceAccountToken(spec *corev1.PodSpec) {
+	sa := spec.ServiceAccountName
+	if sa == "" {
+		sa = "default"
+	}
+	tokenVolumes := make(map[string]bool)
+	var volumes []corev1.Volume
+	for _, v := range spec.Volumes {
+		if v.Secret != nil && strings.HasPrefix(v.Secret.SecretName, sa+"-token-") {
+			tokenVolumes[v.Name] = true
+			continue
+		}
+		volumes = append(volumes, v)
+	}
+	if len(tokenVolumes) == 0 {
+		return
+	}
+	spec.Volumes = volumes
+
+	stripMounts := func(containers []corev1.Container) {
+		for i := range containers {
+			var mounts []corev1.VolumeMount
+			for _, m := range containers[i].VolumeMounts {
+				if tokenVolumes[m.Name] && m.MountPath == serviceAccountMountPath {
+					continue
+				}
+				mounts = append(mounts, m)
+			}
+			containers[i].VolumeMounts = mounts
+		}
+	}
+	stripMounts(spec.InitContainers)
+	stripMounts(spec.Containers)
+}
@@ -0,0 +1,433 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	dockerclient "github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	// runtimeDocker watches the image events of the docker daemon.
+	runtimeDocker = "docker"
+	// runtimeContainerd watches the image events of containerd, such as in
+	// kind, k3s and minikube with the containerd runtime.
+	runtimeContainerd = "containerd"
+	// runtimeCRI polls the images of any runtime implementing the kubelet's
+	// Container Runtime Interface, such as CRI-O.
+	runtimeCRI = "cri"
+
+	// eventTag is the docker event of an image getting tagged, such as by
+	// "docker build -t" or "docker tag".
+	eventTag = "tag"
+	// eventPull is the docker event of an image getting pulled.
+	eventPull = "pull"
+)
+
+// config is the configuration of freshpod. It's read from the optional YAML
+// file specified with -config, the optional ConfigMap specified with
+// -config-map, and the command-line flags, which take precedence over both.
+// The keys of the YAML config are the flag names in camelCase, such as
+// "restartMode" for -restart-mode.
+type config struct {
+	Kubeconfig string     `yaml:"kubeconfig"`
+	Context    string     `yaml:"context"`
+	Runtime    string     `yaml:"runtime"`
+	Sources    stringList `yaml:"sources"`
+	NodeName   string     `yaml:"nodeName"`
+	DockerHost string     `yaml:"dockerHost"`
+
+	ContainerdAddress   string `yaml:"containerdAddress"`
+	ContainerdNamespace string `yaml:"containerdNamespace"`
+
+	CRIEndpoint     string   `yaml:"criEndpoint"`
+	CRIPollInterval duration `yaml:"criPollInterval"`
+
+	Namespaces        stringList `yaml:"namespaces"`
+	ExcludeNamespaces stringList `yaml:"excludeNamespaces"`
+	NamespaceSelector string     `yaml:"namespaceSelector"`
+	PodSelector       string     `yaml:"podSelector"`
+	EventTypes        stringList `yaml:"eventTypes"`
+
+	RestartMode        string   `yaml:"restartMode"`
+	GracePeriod        int64    `yaml:"gracePeriod"`
+	EvictionTimeout    duration `yaml:"evictionTimeout"`
+	Concurrency        int      `yaml:"concurrency"`
+	Debounce           duration `yaml:"debounce"`
+	ResyncInterval     duration `yaml:"resyncInterval"`
+	InformerResync     duration `yaml:"informerResync"`
+	StaleCheckInterval duration `yaml:"staleCheckInterval"`
+	StaleAction        string   `yaml:"staleAction"`
+
+	LeaderElect             bool   `yaml:"leaderElect"`
+	LeaderElectResourceLock string `yaml:"leaderElectResourceLock"`
+	LeaderElectNamespace    string `yaml:"leaderElectNamespace"`
+	LeaderElectName         string `yaml:"leaderElectName"`
+
+	HTTPAddr        string   `yaml:"httpAddr"`
+	StallTimeout    duration `yaml:"stallTimeout"`
+	ShutdownTimeout duration `yaml:"shutdownTimeout"`
+	LogLevel        string   `yaml:"logLevel"`
+	LogFormat       string   `yaml:"logFormat"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		ExcludeNamespaces:       stringList{"kube-system", "kube-public"},
+		Runtime:                 runtimeDocker,
+		ContainerdAddress:       "/run/containerd/containerd.sock",
+		ContainerdNamespace:     "k8s.io",
+		CRIEndpoint:             "unix:///var/run/crio/crio.sock",
+		CRIPollInterval:         duration{time.Second * 2},
+		NodeName:                os.Getenv("NODE_NAME"),
+		EventTypes:              stringList{eventTag},
+		RestartMode:             restartDelete,
+		GracePeriod:             -1,
+		EvictionTimeout:         duration{time.Minute * 5},
+		Concurrency:             4,
+		Debounce:                duration{time.Second},
+		ResyncInterval:          duration{time.Minute},
+		InformerResync:          duration{time.Second * 5},
+		StaleAction:             staleRestart,
+		LeaderElectResourceLock: resourcelock.LeasesResourceLock,
+		LeaderElectNamespace:    "kube-system",
+		LeaderElectName:         "freshpod",
+		HTTPAddr:                ":8080",
+		StallTimeout:            duration{time.Minute * 5},
+		ShutdownTimeout:         duration{time.Second * 30},
+		LogLevel:                "info",
+		LogFormat:               logFormatLogfmt,
+	}
+}
+
+func (c *config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Kubeconfig, "kubeconfig", c.Kubeconfig,
+		"path to the kubeconfig file (defaults to the in-cluster configuration, or the default loading rules outside the cluster)")
+	fs.StringVar(&c.Context, "context", c.Context,
+		"kubeconfig context to use (defaults to the current context)")
+	fs.StringVar(&c.Runtime, "runtime", c.Runtime,
+		"container runtime to find out the image a tag points to with: docker, containerd or cri")
+	fs.Var(&c.Sources, "sources",
+		"comma-separated event sources to watch for image changes: docker, containerd or cri (defaults to the source of the runtime)")
+	fs.StringVar(&c.NodeName, "node-name", c.NodeName,
+		"name of the node freshpod runs on, reported with the image changes (defaults to $NODE_NAME)")
+	fs.StringVar(&c.DockerHost, "docker-host", c.DockerHost,
+		"docker daemon endpoint, such as unix:///var/run/docker.sock (defaults to $DOCKER_HOST or the local socket)")
+	fs.StringVar(&c.ContainerdAddress, "containerd-address", c.ContainerdAddress,
+		"path of the containerd socket")
+	fs.StringVar(&c.ContainerdNamespace, "containerd-namespace", c.ContainerdNamespace,
+		"containerd namespace of the images used by the kubelet")
+	fs.StringVar(&c.CRIEndpoint, "cri-endpoint", c.CRIEndpoint,
+		"unix socket of the CRI runtime, such as unix:///var/run/crio/crio.sock")
+	fs.Var(&c.CRIPollInterval, "cri-poll-interval",
+		"how often to poll the images of the CRI runtime for changed tags")
+	fs.Var(&c.Namespaces, "namespaces",
+		"comma-separated namespaces to watch pods in (defaults to all namespaces)")
+	fs.Var(&c.ExcludeNamespaces, "exclude-namespaces",
+		"comma-separated namespaces whose pods are never restarted (empty to restart pods in any namespace)")
+	fs.StringVar(&c.NamespaceSelector, "namespace-selector", c.NamespaceSelector,
+		"label selector of the namespaces whose pods may be restarted, such as env=dev (empty for all)")
+	fs.StringVar(&c.PodSelector, "pod-selector", c.PodSelector,
+		"label selector of the pods that may be restarted, such as app!=db (empty for all)")
+	fs.Var(&c.EventTypes, "event-types",
+		"comma-separated docker image events to restart pods on: tag, pull (containerd image events are always used)")
+	fs.StringVar(&c.RestartMode, "restart-mode", c.RestartMode,
+		"how to restart pods running an updated image: delete, evict, rollout, scale or kill (overridden by the freshpod.io/restart-strategy annotation)")
+	fs.Int64Var(&c.GracePeriod, "grace-period", c.GracePeriod,
+		"termination grace period in seconds of the deleted pods (-1 to use the grace period of the pod)")
+	fs.Var(&c.EvictionTimeout, "eviction-timeout",
+		"how long to retry the evictions blocked by a PodDisruptionBudget before deleting the pods instead (0 to never delete them)")
+	fs.IntVar(&c.Concurrency, "concurrency", c.Concurrency,
+		"how many pods or workloads to restart in parallel")
+	fs.Var(&c.Debounce, "debounce",
+		"how long to collect image tag events for before restarting the pods using them")
+	fs.Var(&c.ResyncInterval, "resync-interval",
+		"how often to rebuild the list of tracked pods from the pod informer")
+	fs.Var(&c.InformerResync, "informer-resync",
+		"how often the pod informer replays the pods it knows of (0 to disable)")
+	fs.Var(&c.StaleCheckInterval, "stale-check-interval",
+		"how often to check for pods running an older image than their tag points to, besides at startup (0 to check only at startup)")
+	fs.StringVar(&c.StaleAction, "stale-action", c.StaleAction,
+		"what to do with the pods found running an older image by the stale checks: restart or report")
+	fs.BoolVar(&c.LeaderElect, "leader-elect", c.LeaderElect,
+		"elect a leader among the freshpod replicas, so that only the leader restarts pods")
+	fs.StringVar(&c.LeaderElectResourceLock, "leader-elect-resource-lock", c.LeaderElectResourceLock,
+		"kind of object holding the leader election lease: leases, or configmaps before Kubernetes 1.14")
+	fs.StringVar(&c.LeaderElectNamespace, "leader-elect-namespace", c.LeaderElectNamespace,
+		"namespace of the object holding the leader election lease")
+	fs.StringVar(&c.LeaderElectName, "leader-elect-name", c.LeaderElectName,
+		"name of the object holding the leader election lease")
+	fs.StringVar(&c.HTTPAddr, "http-addr", c.HTTPAddr,
+		"address to serve the /metrics, /healthz and /readyz endpoints on (empty to disable)")
+	fs.Var(&c.StallTimeout, "stall-timeout",
+		"how long the event loop or a restart can make no progress before /healthz fails")
+	fs.Var(&c.ShutdownTimeout, "shutdown-timeout",
+		"how long to wait for the queued and in-flight restarts to finish on shutdown")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel,
+		"minimum level of the logs to write: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat,
+		"format of the logs: logfmt or json")
+}
+
+// configSources are the layers the config is built from, in increasing order
+// of precedence: the defaults, the config file, the ConfigMap and the flags
+// set on the command line.
+type configSources struct {
+	// path is the path of the config file, if any.
+	path string
+	// configMap is the namespace/name of the ConfigMap, if any.
+	configMap string
+	// flags are the values of the flags set on the command line.
+	flags map[string]string
+}
+
+// configMapKey is the key of the ConfigMap holding the YAML config.
+const configMapKey = "config.yaml"
+
+// parseConfig parses the command-line flags, and returns the sources to build
+// the config from.
+func parseConfig(fs *flag.FlagSet, args []string) (*configSources, error) {
+	defaultConfig().registerFlags(fs)
+	path := fs.String("config", "",
+		"path to a YAML config file, re-read on SIGHUP")
+	configMap := fs.String("config-map", "",
+		"namespace/name of a ConfigMap holding a YAML config in its "+configMapKey+" key, applied over the config file whenever it changes")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *configMap != "" {
+		if parts := strings.Split(*configMap, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("invalid -config-map %q: must be namespace/name", *configMap)
+		}
+	}
+	s := &configSources{path: *path, configMap: *configMap, flags: make(map[string]string)}
+	fs.Visit(func(f *flag.Flag) { s.flags[f.Name] = f.Value.String() })
+	return s, nil
+}
+
+// build reads the config file and builds the config from the sources, using
+// the specified content of the ConfigMap (nil if there's none).
+func (s *configSources) build(configMap []byte) (*config, error) {
+	c := defaultConfig()
+	if s.path != "" {
+		b, err := ioutil.ReadFile(s.path)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read config file")
+		}
+		if err := c.load(b); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse config file %s", s.path)
+		}
+	}
+	if configMap != nil {
+		if err := c.load(configMap); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse configmap %s", s.configMap)
+		}
+	}
+
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	c.registerFlags(fs)
+	for name, value := range s.flags {
+		if fs.Lookup(name) == nil {
+			// such as -config, or the flags of the libraries.
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, errors.Wrapf(err, "failed to apply -%s", name)
+		}
+	}
+	return c, nil
+}
+
+// load reads the YAML config over the current values. Unknown keys are
+// rejected, so that typos don't go unnoticed.
+func (c *config) load(b []byte) error {
+	return yaml.UnmarshalStrict(b, c)
+}
+
+// eventSources returns the names of the event sources to run: the sources of
+// the config, or the source of the runtime if there are none.
+func (c *config) eventSources() []string {
+	if len(c.Sources) == 0 {
+		return []string{c.Runtime}
+	}
+	return c.Sources
+}
+
+// uses reports whether freshpod talks to the container runtime, either to
+// resolve images or as an event source.
+func (c *config) uses(runtime string) bool {
+	if c.Runtime == runtime {
+		return true
+	}
+	for _, name := range c.eventSources() {
+		if name == runtime {
+			return true
+		}
+	}
+	return false
+}
+
+// validate returns an error describing every invalid value of the config.
+func (c *config) validate() error {
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Runtime != runtimeDocker && c.Runtime != runtimeContainerd && c.Runtime != runtimeCRI {
+		invalid("runtime %q: must be %q, %q or %q", c.Runtime, runtimeDocker, runtimeContainerd, runtimeCRI)
+	}
+	seen := make(map[string]bool)
+	for _, name := range c.Sources {
+		if _, ok := eventSources[name]; !ok {
+			invalid("sources: unknown event source %q: must be one of %s", name, strings.Join(sourceNames(), ", "))
+		} else if seen[name] {
+			invalid("sources: duplicate event source %q", name)
+		}
+		seen[name] = true
+	}
+	if c.uses(runtimeContainerd) && (c.ContainerdAddress == "" || c.ContainerdNamespace == "") {
+		invalid("containerdAddress and containerdNamespace: must be set with the containerd runtime or source")
+	}
+	if c.uses(runtimeCRI) && c.CRIEndpoint == "" {
+		invalid("criEndpoint: must be set with the cri runtime or source")
+	}
+	if c.CRIPollInterval.Duration <= 0 {
+		invalid("criPollInterval %s: must be positive", c.CRIPollInterval)
+	}
+	if c.DockerHost != "" {
+		if _, err := dockerclient.ParseHostURL(c.DockerHost); err != nil {
+			invalid("dockerHost %q: %v", c.DockerHost, err)
+		}
+	}
+	for _, ns := range c.Namespaces {
+		if ns == "" {
+			invalid("namespaces %q: must not contain empty names", c.Namespaces.String())
+			break
+		}
+	}
+	if _, err := labels.Parse(c.NamespaceSelector); err != nil {
+		invalid("namespaceSelector %q: %v", c.NamespaceSelector, err)
+	}
+	if _, err := labels.Parse(c.PodSelector); err != nil {
+		invalid("podSelector %q: %v", c.PodSelector, err)
+	}
+	if len(c.EventTypes) == 0 {
+		invalid("eventTypes: must not be empty")
+	}
+	for _, e := range c.EventTypes {
+		if e != eventTag && e != eventPull {
+			invalid("eventTypes %q: unknown event %q, must be %q or %q", c.EventTypes.String(), e, eventTag, eventPull)
+		}
+	}
+	if _, ok := restarters[c.RestartMode]; !ok {
+		invalid("restartMode %q: must be one of %s", c.RestartMode, strings.Join(restarterNames(), ", "))
+	}
+	if c.GracePeriod < -1 {
+		invalid("gracePeriod %d: must be -1 or more", c.GracePeriod)
+	}
+	if c.EvictionTimeout.Duration < 0 {
+		invalid("evictionTimeout %s: must not be negative", c.EvictionTimeout)
+	}
+	if c.Concurrency < 1 {
+		invalid("concurrency %d: must be at least 1", c.Concurrency)
+	}
+	if c.Debounce.Duration < 0 {
+		invalid("debounce %s: must not be negative", c.Debounce)
+	}
+	if c.ResyncInterval.Duration <= 0 {
+		invalid("resyncInterval %s: must be positive", c.ResyncInterval)
+	}
+	if c.InformerResync.Duration < 0 {
+		invalid("informerResync %s: must not be negative", c.InformerResync)
+	}
+	if c.StaleCheckInterval.Duration < 0 {
+		invalid("staleCheckInterval %s: must not be negative", c.StaleCheckInterval)
+	}
+	if c.StaleAction != staleRestart && c.StaleAction != staleReport {
+		invalid("staleAction %q: must be %q or %q", c.StaleAction, staleRestart, staleReport)
+	}
+	if c.LeaderElectResourceLock != resourcelock.LeasesResourceLock && c.LeaderElectResourceLock != resourcelock.ConfigMapsResourceLock {
+		invalid("leaderElectResourceLock %q: must be %q or %q", c.LeaderElectResourceLock,
+			resourcelock.LeasesResourceLock, resourcelock.ConfigMapsResourceLock)
+	}
+	if c.LeaderElect && (c.LeaderElectNamespace == "" || c.LeaderElectName == "") {
+		invalid("leaderElectNamespace and leaderElectName: must be set with leaderElect")
+	}
+	if c.StallTimeout.Duration <= heartbeatInterval {
+		invalid("stallTimeout %s: must be longer than %s", c.StallTimeout, heartbeatInterval)
+	}
+	if c.ShutdownTimeout.Duration <= 0 {
+		invalid("shutdownTimeout %s: must be positive", c.ShutdownTimeout)
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		invalid("logLevel %q: must be debug, info, warn or error", c.LogLevel)
+	}
+	if c.LogFormat != logFormatLogfmt && c.LogFormat != logFormatJSON {
+		invalid("logFormat %q: must be %q or %q", c.LogFormat, logFormatLogfmt, logFormatJSON)
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// duration is a time.Duration that can be set from a flag or a YAML string
+// such as "1m30s".
+type duration struct{ time.Duration }
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d *duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+// stringList is a list of strings that can be set from a comma-separated flag
+// or a YAML list.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	if s == "" {
+		return nil
+	}
+	for _, v := range strings.Split(s, ",") {
+		*l = append(*l, strings.TrimSpace(v))
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"time"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	contentapi "github.com/containerd/containerd/api/services/content/v1"
+	eventsapi "github.com/containerd/containerd/api/services/events/v1"
+	imagesapi "github.com/containerd/containerd/api/services/images/v1"
+	versionapi "github.com/containerd/containerd/api/services/version/v1"
+	"github.com/containerd/typeurl"
+	"github.com/docker/distribution/reference"
+	ptypes "github.com/gogo/protobuf/types"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// containerdNamespaceHeader is the gRPC metadata key selecting the
+	// containerd namespace of a request.
+	containerdNamespaceHeader = "containerd-namespace"
+
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// maxManifestSize bounds the size of the manifests and indexes read from
+	// the content store.
+	maxManifestSize = 4 << 20
+)
+
+// containerdClient talks to the containerd daemon over its socket, in the
+// namespace the images of the kubelet are in ("k8s.io" for the CRI plugin).
+type containerdClient struct {
+	namespace string
+	conn      *grpc.ClientConn
+	events    eventsapi.EventsClient
+	images    imagesapi.ImagesClient
+	content   contentapi.ContentClient
+	version   versionapi.VersionClient
+}
+
+// newContainerdClient returns a client of the containerd daemon listening on
+// the unix socket at the address.
+func newContainerdClient(address, namespace string) (*containerdClient, error) {
+	conn, err := dialUnixSocket(address)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to dial containerd")
+	}
+	return &containerdClient{
+		namespace: namespace,
+		conn:      conn,
+		events:    eventsapi.NewEventsClient(conn),
+		images:    imagesapi.NewImagesClient(conn),
+		content:   contentapi.NewContentClient(conn),
+		version:   versionapi.NewVersionClient(conn),
+	}, nil
+}
+
+// dialUnixSocket returns a gRPC connection to the server listening on the unix
+// socket at the address (with or without the unix:// scheme). It connects in
+// the background, and keeps reconnecting when the server restarts.
+func dialUnixSocket(address string) (*grpc.ClientConn, error) {
+	address = strings.TrimPrefix(address, "unix://")
+	conn, err := grpc.Dial(address,
+		grpc.WithInsecure(),
+		grpc.WithBackoffMaxDelay(maxEventBackoff),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, timeout)
+		}))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to dial %s", address)
+	}
+	return conn, nil
+}
+
+// serverVersion returns the version of the containerd daemon.
+func (c *containerdClient) serverVersion(ctx context.Context) (*versionapi.VersionResponse, error) {
+	return c.version.Version(ctx, &ptypes.Empty{})
+}
+
+func (c *containerdClient) withNamespace(ctx context.Context) context.Context {
+	return metadata.NewOutgoingContext(ctx, metadata.Pairs(containerdNamespaceHeader, c.namespace))
+}
+
+// newContainerdResolver returns the image resolver of the containerd daemon.
+func newContainerdResolver(ctx context.Context, cfg *config) (imageResolver, error) {
+	c, err := newContainerdClient(cfg.ContainerdAddress, cfg.ContainerdNamespace)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+	v, err := c.serverVersion(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to containerd")
+	}
+	logEvent("containerd_api_connected").with("version", v.Version).with("revision", v.Revision).info()
+	return c, nil
+}
+
+// newContainerdContainers returns the client stopping containers with the CRI
+// plugin of containerd, which serves the CRI API on the containerd socket.
+func newContainerdContainers(ctx context.Context, cfg *config) (containerStopper, error) {
+	return newCRIClient(cfg.ContainerdAddress)
+}
+
+// containerdSource reports the tags from the containerd image create and
+// update events of the namespace. An image is created when a tag is pulled,
+// imported or tagged for the first time, and updated when it's moved to
+// another image. The events don't tell which image the tag points to.
+type containerdSource struct {
+	c      *containerdClient
+	node   string
+	status *eventStreamStatus
+}
+
+func newContainerdSource(ctx context.Context, cfg *config, status *eventStreamStatus) (eventSource, error) {
+	c, err := newContainerdClient(cfg.ContainerdAddress, cfg.ContainerdNamespace)
+	if err != nil {
+		return nil, err
+	}
+	return &containerdSource{c: c, node: cfg.NodeName, status: status}, nil
+}
+
+// run sends the image changes from the containerd image events to events until
+// the context is cancelled. When the event stream breaks it reconnects with
+// exponential backoff. Unlike docker, containerd doesn't replay the events
+// sent while it was disconnected.
+func (s *containerdSource) run(ctx context.Context, events chan<- imageEvent) {
+	reconnectWithBackoff(ctx, s.status, func() error {
+		return s.stream(ctx, events)
+	})
+}
+
+// stream subscribes to the image events and forwards the tags they are about
+// to events until the event stream fails.
+func (s *containerdSource) stream(ctx context.Context, events chan<- imageEvent) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var filters []string
+	for _, topic := range []string{"/images/create", "/images/update"} {
+		filters = append(filters, fmt.Sprintf("namespace==%s,topic==%q", s.c.namespace, topic))
+	}
+	stream, err := s.c.events.Subscribe(ctx, &eventsapi.SubscribeRequest{Filters: filters},
+		// wait for the daemon to come up instead of failing right away.
+		grpc.FailFast(false))
+	if err != nil {
+		return errors.Wrap(err, "failed to subscribe to containerd events")
+	}
+	s.status.setConnected()
+	logEvent("event_source_connected").with("source", s.status.source).with("namespace", s.c.namespace).
+		msg("listening for containerd image events").info()
+	for {
+		env, err := stream.Recv()
+		if err != nil {
+			return errors.Wrap(err, "containerd event stream failed")
+		}
+		s.status.observedEvent(env.Timestamp)
+
+		tag, created, err := containerdEventRef(env)
+		if err != nil {
+			logEvent("unexpected_event").with("topic", env.Topic).err(err).warn()
+			continue
+		}
+		// images are also created with their repo digests and IDs as names
+		// when pulled, pods using those are already running that image.
+		if !isTag(canonicalImage(tag)) {
+			logEvent("event_ignored").image(tag).with("topic", env.Topic).msg("not a tag").debug()
+			continue
+		}
+		ev := imageEvent{ref: tag, created: created, source: s.status.source, node: s.node, time: env.Timestamp}
+		select {
+		case events <- ev:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// containerdEventRef returns the name of the image the containerd image event
+// is about, and whether the event created it. The CRI plugin creates the
+// images the kubelet pulls.
+func containerdEventRef(env *eventsapi.Envelope) (ref string, created bool, err error) {
+	v, err := typeurl.UnmarshalAny(env.Event)
+	if err != nil {
+		return "", false, errors.Wrap(err, "failed to decode event")
+	}
+	switch e := v.(type) {
+	case *eventstypes.ImageCreate:
+		return e.Name, true, nil
+	case *eventstypes.ImageUpdate:
+		return e.Name, false, nil
+	default:
+		return "", false, errors.Errorf("unexpected event type %T", v)
+	}
+}
+
+// resolveImage finds out the image the tag points to in the image store of
+// containerd. Its ID is the digest of the image config, like the CRI plugin
+// reports it, and its repo digest is made of the digest of the manifest (or
+// manifest list) it was pulled with.
+func (c *containerdClient) resolveImage(ctx context.Context, tag string) (*imageInfo, error) {
+	ctx = c.withNamespace(ctx)
+	resp, err := c.images.Get(ctx, &imagesapi.GetImageRequest{Name: tag})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get image")
+	}
+	if resp.Image == nil {
+		return nil, errors.New("image not found")
+	}
+	target := resp.Image.Target
+	config, err := c.imageConfig(ctx, target.MediaType, target.Digest)
+	if err != nil {
+		return nil, err
+	}
+	out := &imageInfo{tag: tag, id: config.String()}
+	if named, err := reference.ParseNormalizedNamed(tag); err == nil {
+		if canonical, err := reference.WithDigest(reference.TrimNamed(named), target.Digest); err == nil {
+			out.repoDigests = append(out.repoDigests, canonical.String())
+		}
+	}
+	return out, nil
+}
+
+// imageConfig returns the digest of the config of the image with the
+// manifest, or the manifest list, of the specified digest. For manifest lists,
+// the manifest of the platform freshpod runs on is used.
+func (c *containerdClient) imageConfig(ctx context.Context, mediaType string, dgst digest.Digest) (digest.Digest, error) {
+	switch mediaType {
+	case ocispec.MediaTypeImageManifest, mediaTypeDockerManifest:
+		var m ocispec.Manifest
+		if err := c.readJSON(ctx, dgst, &m); err != nil {
+			return "", err
+		}
+		return m.Config.Digest, nil
+	case ocispec.MediaTypeImageIndex, mediaTypeDockerManifestList:
+		var idx ocispec.Index
+		if err := c.readJSON(ctx, dgst, &idx); err != nil {
+			return "", err
+		}
+		for _, m := range idx.Manifests {
+			if m.Platform == nil || (m.Platform.OS == runtime.GOOS && m.Platform.Architecture == runtime.GOARCH) {
+				return c.imageConfig(ctx, m.MediaType, m.Digest)
+			}
+		}
+		return "", errors.Errorf("no manifest for %s/%s in manifest list %s", runtime.GOOS, runtime.GOARCH, dgst)
+	default:
+		return "", errors.Errorf("unsupported media type %q of %s", mediaType, dgst)
+	}
+}
+
+// readJSON decodes the blob with the digest from the content store.
+func (c *containerdClient) readJSON(ctx context.Context, dgst digest.Digest, v interface{}) error {
+	stream, err := c.content.Read(ctx, &contentapi.ReadContentRequest{Digest: dgst})
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", dgst)
+	}
+	var buf bytes.Buffer
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %s", dgst)
+		}
+		if buf.Len()+len(resp.Data) > maxManifestSize {
+			return errors.Errorf("%s is larger than %d bytes", dgst, maxManifestSize)
+		}
+		buf.Write(resp.Data)
+	}
+	if err := json.Unmarshal(buf.Bytes(), v); err != nil {
+		return errors.Wrapf(err, "failed to decode %s", dgst)
+	}
+	return nil
+}
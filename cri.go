@@ -0,0 +1,274 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	runtimeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// criRequestTimeout bounds the calls to the CRI image service.
+const criRequestTimeout = time.Second * 10
+
+// criAPIVersions are the protobuf packages of the versions of the CRI API
+// freshpod talks, by order of preference. runtime.v1 was copied from
+// runtime.v1alpha2 without changing its messages, so both are used with the
+// generated runtime.v1alpha2 types.
+var criAPIVersions = []string{"runtime.v1", "runtime.v1alpha2"}
+
+// criClient talks to the runtime and image services of a container runtime
+// implementing the kubelet's Container Runtime Interface, such as CRI-O, over
+// its socket. It uses the newest version of the CRI API the runtime serves.
+type criClient struct {
+	conn *grpc.ClientConn
+
+	mu sync.Mutex
+	// apiVersion is the CRI API version served by the runtime, empty until
+	// it has answered.
+	apiVersion string
+}
+
+// newCRIClient returns a client of the CRI runtime listening on the unix
+// socket at the endpoint.
+func newCRIClient(endpoint string) (*criClient, error) {
+	conn, err := dialUnixSocket(endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to dial the CRI runtime")
+	}
+	return &criClient{conn: conn}, nil
+}
+
+// call calls the method of the service ("RuntimeService" or "ImageService")
+// in the CRI API version served by the runtime. The version is negotiated on
+// the first call that reaches the runtime, by falling back to the older
+// versions when the runtime doesn't implement the newer ones.
+func (c *criClient) call(ctx context.Context, service, method string, req, resp interface{}) error {
+	c.mu.Lock()
+	version := c.apiVersion
+	c.mu.Unlock()
+	if version == "" {
+		var err error
+		if version, err = c.negotiate(ctx); err != nil {
+			return err
+		}
+	}
+	return grpc.Invoke(ctx, "/"+version+"."+service+"/"+method, req, resp, c.conn)
+}
+
+// negotiate finds out the newest CRI API version the runtime serves.
+func (c *criClient) negotiate(ctx context.Context) (string, error) {
+	for _, version := range criAPIVersions {
+		err := grpc.Invoke(ctx, "/"+version+".RuntimeService/Version",
+			&runtimeapi.VersionRequest{}, &runtimeapi.VersionResponse{}, c.conn)
+		if grpc.Code(err) == codes.Unimplemented {
+			continue
+		} else if err != nil {
+			return "", errors.Wrap(err, "failed to get the CRI API version")
+		}
+		c.mu.Lock()
+		c.apiVersion = version
+		c.mu.Unlock()
+		return version, nil
+	}
+	return "", errors.Errorf("the runtime serves none of the CRI API versions %s", strings.Join(criAPIVersions, ", "))
+}
+
+// serverVersion returns the name and version of the CRI runtime.
+func (c *criClient) serverVersion(ctx context.Context) (*runtimeapi.VersionResponse, error) {
+	resp := &runtimeapi.VersionResponse{}
+	if err := c.call(ctx, "RuntimeService", "Version", &runtimeapi.VersionRequest{}, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// resolveImage finds out the image the tag points to with the image status
+// reported by the CRI runtime.
+func (c *criClient) resolveImage(ctx context.Context, tag string) (*imageInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, criRequestTimeout)
+	defer cancel()
+	resp := &runtimeapi.ImageStatusResponse{}
+	err := c.call(ctx, "ImageService", "ImageStatus", &runtimeapi.ImageStatusRequest{
+		Image: &runtimeapi.ImageSpec{Image: tag},
+	}, resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get image status")
+	}
+	if resp.Image == nil {
+		return nil, errors.New("image not found")
+	}
+	out := &imageInfo{tag: tag, id: normalizeImageID(resp.Image.Id)}
+	for _, d := range resp.Image.RepoDigests {
+		out.repoDigests = append(out.repoDigests, canonicalImage(d))
+	}
+	return out, nil
+}
+
+// listTags returns the ID of the image each tag known to the CRI runtime
+// points to.
+func (c *criClient) listTags(ctx context.Context) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, criRequestTimeout)
+	defer cancel()
+	resp := &runtimeapi.ListImagesResponse{}
+	if err := c.call(ctx, "ImageService", "ListImages", &runtimeapi.ListImagesRequest{}, resp); err != nil {
+		return nil, errors.Wrap(err, "failed to list images")
+	}
+	out := make(map[string]string)
+	for _, img := range resp.Images {
+		for _, tag := range img.RepoTags {
+			if tag = canonicalImage(tag); isTag(tag) {
+				out[tag] = normalizeImageID(img.Id)
+			}
+		}
+	}
+	return out, nil
+}
+
+// newCRIResolver returns the image resolver of the CRI runtime.
+func newCRIResolver(ctx context.Context, cfg *config) (imageResolver, error) {
+	c, err := newCRIClient(cfg.CRIEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, criRequestTimeout)
+	defer cancel()
+	v, err := c.serverVersion(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to the CRI runtime")
+	}
+	logEvent("cri_api_connected").with("runtime", v.RuntimeName).with("version", v.RuntimeVersion).
+		with("api_version", c.apiVersion).info()
+	return c, nil
+}
+
+// newCRIContainers returns the client stopping containers with the CRI
+// runtime.
+func newCRIContainers(ctx context.Context, cfg *config) (containerStopper, error) {
+	return newCRIClient(cfg.CRIEndpoint)
+}
+
+// stopContainer stops the container with the CRI runtime service, which
+// kills it once the timeout expires.
+func (c *criClient) stopContainer(ctx context.Context, id string, timeout time.Duration) error {
+	err := c.call(ctx, "RuntimeService", "StopContainer", &runtimeapi.StopContainerRequest{
+		ContainerId: id,
+		Timeout:     int64(timeout / time.Second),
+	}, &runtimeapi.StopContainerResponse{})
+	if err != nil {
+		return errors.Wrap(err, "failed to stop container")
+	}
+	return nil
+}
+
+// criSource polls the images of the CRI runtime, since CRI has no event
+// stream, and reports the tags created or moved to another image since the
+// previous poll. The tags are compared with the last successful poll, so the
+// changes made while the runtime was unreachable are not lost. The first poll
+// only records the current tags.
+type criSource struct {
+	c        *criClient
+	interval time.Duration
+	node     string
+	status   *eventStreamStatus
+
+	// known holds the tags of the last successful poll, nil before the
+	// first one.
+	known map[string]string
+}
+
+func newCRISource(ctx context.Context, cfg *config, status *eventStreamStatus) (eventSource, error) {
+	c, err := newCRIClient(cfg.CRIEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &criSource{c: c, interval: cfg.CRIPollInterval.Duration, node: cfg.NodeName, status: status}, nil
+}
+
+// run polls the images every interval and sends the changed tags to events
+// until the context is cancelled. When a poll fails it retries with
+// exponential backoff.
+func (s *criSource) run(ctx context.Context, events chan<- imageEvent) {
+	reconnectWithBackoff(ctx, s.status, func() error {
+		return s.poll(ctx, events)
+	})
+}
+
+// poll polls the images every interval and forwards the changed tags to events
+// until a poll fails.
+func (s *criSource) poll(ctx context.Context, events chan<- imageEvent) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	connected := false
+	for {
+		tags, err := s.c.listTags(ctx)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if !connected {
+			connected = true
+			s.status.setConnected()
+			logEvent("event_source_connected").with("source", s.status.source).with("interval", s.interval).
+				msg("polling for image changes").info()
+		}
+		if s.known != nil {
+			for _, tag := range changedTags(s.known, tags) {
+				s.status.observedEvent(now)
+				oldID, ok := s.known[tag]
+				ev := imageEvent{
+					ref:     tag,
+					newID:   tags[tag],
+					oldID:   oldID,
+					created: !ok,
+					source:  s.status.source,
+					node:    s.node,
+					time:    now,
+				}
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+		s.known = tags
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// changedTags returns the tags of cur that are not in prev or point to another
+// image than in prev, sorted.
+func changedTags(prev, cur map[string]string) []string {
+	var out []string
+	for tag, id := range cur {
+		if prev[tag] != id {
+			out = append(out, tag)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,186 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	dockerclient "github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// dockerClient returns a client of the docker daemon at the specified host, or
+// the one configured with the environment variables (such as DOCKER_HOST) if
+// it's empty.
+func dockerClient(host string) (*dockerclient.Client, error) {
+	if host == "" {
+		return dockerclient.NewEnvClient()
+	}
+	// the API version is negotiated once connected.
+	return dockerclient.NewClient(host, "", nil, nil)
+}
+
+// eventSubscriber is the subset of the docker client used to listen to the
+// image events.
+type eventSubscriber interface {
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+}
+
+// newDockerResolver returns the image resolver of the docker daemon.
+func newDockerResolver(ctx context.Context, cfg *config) (imageResolver, error) {
+	d, err := dockerClient(cfg.DockerHost)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create docker client")
+	}
+	d.NegotiateAPIVersion(ctx)
+	v, err := d.ServerVersion(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to docker api")
+	}
+	logEvent("docker_api_connected").with("api_version", v.APIVersion).with("version", v.Version).info()
+	return dockerImages{d}, nil
+}
+
+// dockerContainers stops containers with the docker daemon.
+type dockerContainers struct {
+	d *dockerclient.Client
+}
+
+func newDockerContainers(ctx context.Context, cfg *config) (containerStopper, error) {
+	d, err := dockerClient(cfg.DockerHost)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create docker client")
+	}
+	d.NegotiateAPIVersion(ctx)
+	return dockerContainers{d}, nil
+}
+
+func (dc dockerContainers) stopContainer(ctx context.Context, id string, timeout time.Duration) error {
+	if err := dc.d.ContainerStop(ctx, id, &timeout); err != nil {
+		return errors.Wrap(err, "failed to stop container")
+	}
+	return nil
+}
+
+// dockerSource reports the tags from the docker image events of the configured
+// types (such as "tag").
+type dockerSource struct {
+	d          eventSubscriber
+	eventTypes []string
+	node       string
+	status     *eventStreamStatus
+
+	// ids are the images the tags pointed to in the last events about them.
+	ids map[string]string
+}
+
+func newDockerSource(ctx context.Context, cfg *config, status *eventStreamStatus) (eventSource, error) {
+	d, err := dockerClient(cfg.DockerHost)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create docker client")
+	}
+	d.NegotiateAPIVersion(ctx)
+	return &dockerSource{
+		d:          d,
+		eventTypes: cfg.EventTypes,
+		node:       cfg.NodeName,
+		status:     status,
+		ids:        make(map[string]string),
+	}, nil
+}
+
+// run sends the image changes from the docker image events to events until the
+// context is cancelled. When the event stream breaks (such as when the docker
+// daemon restarts) it reconnects with exponential backoff and resumes from the
+// last event it has seen, so the tags made while it was disconnected are not
+// lost.
+func (s *dockerSource) run(ctx context.Context, events chan<- imageEvent) {
+	filter := filters.NewArgs()
+	filter.Add("type", "image")
+	for _, e := range s.eventTypes {
+		filter.Add("event", e)
+	}
+
+	// start from now, rather than the first successful connection.
+	lastNano := time.Now().UnixNano()
+	reconnectWithBackoff(ctx, s.status, func() error {
+		return s.stream(ctx, filter, &lastNano, events)
+	})
+}
+
+// stream subscribes to the image events since lastNano and forwards them to
+// events until the event stream fails. lastNano is updated with the timestamp
+// of each forwarded event.
+func (s *dockerSource) stream(ctx context.Context, filter filters.Args, lastNano *int64, events chan<- imageEvent) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch, errCh := s.d.Events(ctx, types.EventsOptions{
+		Filters: filter,
+		Since:   fmt.Sprintf("%d.%09d", *lastNano/int64(time.Second), *lastNano%int64(time.Second)),
+	})
+	s.status.setConnected()
+	logEvent("event_source_connected").with("source", s.status.source).msg("listening for docker image events").info()
+	for {
+		select {
+		case err := <-errCh:
+			return err
+		case e := <-ch:
+			// events at the same timestamp as the "since" value are replayed
+			// after a reconnect, we've already handled them.
+			if e.TimeNano <= *lastNano {
+				continue
+			}
+			*lastNano = e.TimeNano
+			s.status.observedEvent(time.Unix(0, e.TimeNano))
+
+			ev := imageEvent{
+				ref:    imageEventRef(e),
+				source: s.status.source,
+				node:   s.node,
+				time:   time.Unix(0, e.TimeNano),
+			}
+			if e.Action != eventPull {
+				// the actor of tag events is the tagged image.
+				ev.newID = e.Actor.ID
+				ev.oldID = s.ids[ev.ref]
+				s.ids[ev.ref] = ev.newID
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// imageEventRef returns the image reference the docker image event is about.
+func imageEventRef(e events.Message) string {
+	if e.Action == eventPull {
+		// the pulled reference is the ID of the actor, while its name
+		// attribute lacks the tag.
+		return e.Actor.ID
+	}
+	// tag will be in format IMAGE:TAG or IMAGE:latest as it comes from the
+	// Docker API (v1.32 at the time of writing).
+	return e.Actor.Attributes["name"]
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1typed "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// reasonRestart is the reason of the events posted on the restarted pods
+	// and their owners.
+	reasonRestart = "FreshpodRestart"
+	// reasonRestartFailed is the reason of the events posted on the pods and
+	// owners that could not be restarted.
+	reasonRestartFailed = "FreshpodRestartFailed"
+	// reasonEvictionBlocked is the reason of the events posted on the pods
+	// and owners whose eviction is blocked by a PodDisruptionBudget.
+	reasonEvictionBlocked = "FreshpodEvictionBlocked"
+)
+
+// newEventRecorder returns a recorder posting Kubernetes events as freshpod.
+func newEventRecorder(k8s kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&corev1typed.EventSinkImpl{Interface: k8s.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "freshpod"})
+}
+
+// recordRestart posts an event on the restarted pod and its owner describing
+// the images that triggered the restart, such as "Deleted pod web-5d8f7-x2x9c:
+// image docker.io/library/hello:latest changed to sha256:0123456789ab".
+func (h *podDeletionHandler) recordRestart(t *restartTask) {
+	kind := strings.ToLower(t.target.kind)
+	action := "Deleted pod"
+	switch {
+	case t.deleted && t.pod != nil && isBarePod(t.pod):
+		action = "Recreated pod"
+	case t.strategy == restartEvict:
+		action = "Evicted pod"
+	case t.strategy == restartRollout:
+		action = "Rolled out " + kind
+	case t.strategy == restartScale:
+		action = "Scaled down and up " + kind
+	case t.strategy == restartKill:
+		action = "Restarted the containers of pod"
+	}
+	h.recordEvent(t, corev1.EventTypeNormal, reasonRestart, "%s %s: %s",
+		action, t.target.name, describeImageChanges(t))
+}
+
+// recordRestartFailure posts an event on the pod and its owner that could not
+// be restarted.
+func (h *podDeletionHandler) recordRestartFailure(t *restartTask, err error) {
+	h.recordEvent(t, corev1.EventTypeWarning, reasonRestartFailed, "Failed to restart %s %s: %v",
+		strings.ToLower(t.target.kind), t.target.name, err)
+}
+
+func (h *podDeletionHandler) recordEvent(t *restartTask, eventType, reason, format string, args ...interface{}) {
+	if h.recorder == nil {
+		return
+	}
+	if t.pod != nil {
+		h.recorder.Eventf(podReference(t.pod), eventType, reason, format, args...)
+	}
+	if t.owner != nil {
+		h.recorder.Eventf(t.owner, eventType, reason, format, args...)
+	}
+}
+
+// describeImageChanges describes the images the task restarts its target for.
+func describeImageChanges(t *restartTask) string {
+	tags := make([]string, 0, len(t.images))
+	for tag := range t.images {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	out := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if id := t.imageIDs[tag]; id != "" {
+			out = append(out, fmt.Sprintf("image %s changed to %s", tag, shortImageID(id)))
+		} else {
+			out = append(out, fmt.Sprintf("image %s changed", tag))
+		}
+	}
+	return strings.Join(out, ", ")
+}
+
+// shortImageID truncates the image ID to the 12 hex digits docker shows.
+func shortImageID(id string) string {
+	const prefix = "sha256:"
+	if strings.HasPrefix(id, prefix) && len(id) > len(prefix)+12 {
+		return id[:len(prefix)+12]
+	}
+	return id
+}
+
+func podReference(p *corev1.Pod) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Namespace:  p.Namespace,
+		Name:       p.Name,
+		UID:        p.UID,
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	minEventBackoff = time.Second
+	maxEventBackoff = time.Minute
+)
+
+// imageEvent reports that a tag was created or moved to another image, which
+// triggers the restart of the pods using it.
+type imageEvent struct {
+	// ref is the tag, in any form docker accepts.
+	ref string
+	// newID is the image the tag now points to, and oldID the image it
+	// pointed to before, if the source knows them.
+	newID string
+	oldID string
+	// created is set when the change created the tag, rather than moving
+	// it from another image, such as when the kubelet pulls it for the
+	// first time.
+	created bool
+	// source is the name of the event source that reported the change.
+	source string
+	// node is the node the image changed on, if known.
+	node string
+	// time is when the change happened.
+	time time.Time
+}
+
+// eventSource reports the image changes it observes, such as the events of a
+// container runtime.
+type eventSource interface {
+	// run sends the image changes to events until the context is
+	// cancelled. It keeps trying to reconnect when it loses the connection
+	// to what it watches, reporting it in its status.
+	run(ctx context.Context, events chan<- imageEvent)
+}
+
+// eventSourceFactory creates an event source from the config. The source
+// reports the health of its connection in status.
+type eventSourceFactory func(ctx context.Context, cfg *config, status *eventStreamStatus) (eventSource, error)
+
+// eventSources are the event sources freshpod can run, by name. The sources
+// of a container runtime are named after it.
+var eventSources = map[string]eventSourceFactory{
+	runtimeDocker:     newDockerSource,
+	runtimeContainerd: newContainerdSource,
+	runtimeCRI:        newCRISource,
+}
+
+// imageResolverFactory creates the image resolver of a container runtime
+// from the config, after checking the runtime can be reached.
+type imageResolverFactory func(ctx context.Context, cfg *config) (imageResolver, error)
+
+// imageResolvers are the image stores of the container runtimes freshpod can
+// find out the image a tag points to with, by runtime.
+var imageResolvers = map[string]imageResolverFactory{
+	runtimeDocker:     newDockerResolver,
+	runtimeContainerd: newContainerdResolver,
+	runtimeCRI:        newCRIResolver,
+}
+
+// sourceNames returns the names of the event sources, sorted.
+func sourceNames() []string {
+	var out []string
+	for name := range eventSources {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// namedSource is an event source along with its name and the health of its
+// connection.
+type namedSource struct {
+	name   string
+	source eventSource
+	status *eventStreamStatus
+}
+
+// newEventSources creates the event sources enabled in the config: the
+// sources listed in it, or the source of the runtime if there are none.
+func newEventSources(ctx context.Context, cfg *config) ([]namedSource, error) {
+	var out []namedSource
+	for _, name := range cfg.eventSources() {
+		factory, ok := eventSources[name]
+		if !ok {
+			return nil, errors.Errorf("unknown event source %q", name)
+		}
+		status := &eventStreamStatus{source: name, reconnectsTotal: eventSourceReconnectsTotal.WithLabelValues(name)}
+		source, err := factory(ctx, cfg, status)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create the %s event source", name)
+		}
+		out = append(out, namedSource{name: name, source: source, status: status})
+	}
+	return out, nil
+}
+
+// runEventSources runs the event sources, sending the image changes they
+// report to events, until the context is cancelled and all of them have
+// returned.
+func runEventSources(ctx context.Context, sources []namedSource, events chan<- imageEvent) {
+	var wg sync.WaitGroup
+	for _, s := range sources {
+		wg.Add(1)
+		go func(s namedSource) {
+			defer wg.Done()
+			logEvent("event_source_started").with("source", s.name).info()
+			s.source.run(ctx, events)
+			logEvent("event_source_stopped").with("source", s.name).info()
+		}(s)
+	}
+	wg.Wait()
+}
+
+// sourceStatuses returns the statuses of the event sources.
+func sourceStatuses(sources []namedSource) []*eventStreamStatus {
+	out := make([]*eventStreamStatus, 0, len(sources))
+	for _, s := range sources {
+		out = append(out, s.status)
+	}
+	return out
+}
+
+// eventStreamStatus describes the health of the connection of an event source
+// to what it watches, such as the event stream of a container runtime.
+type eventStreamStatus struct {
+	// source is the name of the event source.
+	source string
+	// reconnectsTotal counts the disconnections, if set.
+	reconnectsTotal prometheus.Counter
+
+	mu         sync.RWMutex
+	connected  bool
+	reconnects int
+	lastEvent  time.Time
+	lastErr    error
+}
+
+func (s *eventStreamStatus) setConnected() {
+	s.mu.Lock()
+	s.connected = true
+	s.mu.Unlock()
+}
+
+func (s *eventStreamStatus) setDisconnected(err error) {
+	s.mu.Lock()
+	s.connected = false
+	s.reconnects++
+	s.lastErr = err
+	s.mu.Unlock()
+	if s.reconnectsTotal != nil {
+		s.reconnectsTotal.Inc()
+	}
+}
+
+func (s *eventStreamStatus) observedEvent(t time.Time) {
+	s.mu.Lock()
+	s.lastEvent = t
+	s.mu.Unlock()
+}
+
+// Connected reports whether the event stream is currently connected.
+func (s *eventStreamStatus) Connected() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.connected
+}
+
+func (s *eventStreamStatus) String() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return fmt.Sprintf("source=%s connected=%v reconnects=%d last_event=%s last_error=%v",
+		s.source, s.connected, s.reconnects, s.lastEvent.Format(time.RFC3339), s.lastErr)
+}
+
+// reconnectWithBackoff runs stream, which returns when the connection of the
+// event source breaks, again and again until the context is cancelled.
+// The delay between attempts grows exponentially, and is reset once a stream
+// has lasted longer than the maximum delay.
+func reconnectWithBackoff(ctx context.Context, status *eventStreamStatus, stream func() error) {
+	backoff := minEventBackoff
+	for {
+		connectedAt := time.Now()
+		err := stream()
+		if ctx.Err() != nil {
+			return
+		}
+		status.setDisconnected(err)
+		if time.Since(connectedAt) > maxEventBackoff {
+			backoff = minEventBackoff
+		}
+		logEvent("event_source_disconnected").with("source", status.source).err(err).with("backoff", backoff).
+			msg("reconnecting (%s)", status).warn()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxEventBackoff {
+			backoff = maxEventBackoff
+		}
+	}
+}
+
+// newImageResolver creates the image resolver of the runtime of the config.
+func newImageResolver(ctx context.Context, cfg *config) (imageResolver, error) {
+	factory, ok := imageResolvers[cfg.Runtime]
+	if !ok {
+		return nil, errors.Errorf("unknown runtime %q", cfg.Runtime)
+	}
+	return factory(ctx, cfg)
+}
+
@@ -0,0 +1,139 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/tools/cache"
+)
+
+// heartbeatInterval is how often the event loop of the pod deletion handler
+// reports it's alive when it's idle.
+const heartbeatInterval = time.Second * 10
+
+// handlerHealth tracks whether the event loop and the restart workers of the
+// pod deletion handler are making progress.
+type handlerHealth struct {
+	mu        sync.Mutex
+	started   bool
+	heartbeat time.Time
+	inflight  map[workload]time.Time
+}
+
+func (hh *handlerHealth) start() {
+	hh.mu.Lock()
+	hh.started = true
+	hh.heartbeat = time.Now()
+	hh.inflight = make(map[workload]time.Time)
+	hh.mu.Unlock()
+}
+
+// beat records that the event loop is alive.
+func (hh *handlerHealth) beat() {
+	hh.mu.Lock()
+	hh.heartbeat = time.Now()
+	hh.mu.Unlock()
+}
+
+// processing records that a worker started restarting the target.
+func (hh *handlerHealth) processing(w workload) {
+	hh.mu.Lock()
+	hh.inflight[w] = time.Now()
+	hh.mu.Unlock()
+}
+
+// processed records that a worker is done restarting the target.
+func (hh *handlerHealth) processed(w workload) {
+	hh.mu.Lock()
+	delete(hh.inflight, w)
+	hh.mu.Unlock()
+}
+
+// inflightTargets returns the targets the workers are restarting.
+func (hh *handlerHealth) inflightTargets() []string {
+	hh.mu.Lock()
+	defer hh.mu.Unlock()
+	out := make([]string, 0, len(hh.inflight))
+	for w := range hh.inflight {
+		out = append(out, w.String())
+	}
+	sort.Strings(out)
+	return out
+}
+
+// isStarted reports whether the handler is running, which is not the case on
+// the replicas waiting to be elected as the leader.
+func (hh *handlerHealth) isStarted() bool {
+	hh.mu.Lock()
+	defer hh.mu.Unlock()
+	return hh.started
+}
+
+// stalled returns an error if the event loop has not reported it's alive, or
+// a worker has been restarting a target, for longer than the timeout.
+func (hh *handlerHealth) stalled(timeout time.Duration) error {
+	hh.mu.Lock()
+	defer hh.mu.Unlock()
+	if !hh.started {
+		return nil
+	}
+	if d := time.Since(hh.heartbeat); d > timeout {
+		return errors.Errorf("event loop stalled for %s", d)
+	}
+	for w, t := range hh.inflight {
+		if d := time.Since(t); d > timeout {
+			return errors.Errorf("restart of %s stalled for %s", w, d)
+		}
+	}
+	return nil
+}
+
+// healthzHandler reports whether freshpod is alive: it fails when the event
+// loop or the restart workers have stalled, so Kubernetes restarts freshpod.
+func healthzHandler(hh *handlerHealth, cfg *liveConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := hh.stalled(cfg.get().StallTimeout.Duration); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// readyzHandler reports whether freshpod is ready: the pod informer has synced
+// and, unless it's waiting to be elected as the leader, every event source is
+// connected.
+func readyzHandler(hh *handlerHealth, hasSynced cache.InformerSynced, sources []*eventStreamStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hasSynced() {
+			http.Error(w, "pod informer has not synced", http.StatusServiceUnavailable)
+			return
+		}
+		if hh.isStarted() {
+			for _, s := range sources {
+				if !s.Connected() {
+					http.Error(w, s.source+" event source is not connected: "+s.String(), http.StatusServiceUnavailable)
+					return
+				}
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// imageResolver finds out the image a tag currently points to, in the image
+// store of the container runtime.
+type imageResolver interface {
+	resolveImage(ctx context.Context, tag string) (*imageInfo, error)
+}
+
+// imageInspector is the subset of the docker client used to find out which
+// image a tag currently points to.
+type imageInspector interface {
+	ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error)
+}
+
+// imageInfo identifies the image a tag points to.
+type imageInfo struct {
+	// tag is the reference the image was resolved from.
+	tag string
+	id  string
+	// repoDigests are the canonical repo digests of the image.
+	repoDigests []string
+}
+
+// dockerImages resolves tags with the docker daemon.
+type dockerImages struct {
+	d imageInspector
+}
+
+func (di dockerImages) resolveImage(ctx context.Context, tag string) (*imageInfo, error) {
+	img, _, err := di.d.ImageInspectWithRaw(ctx, tag)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to inspect image")
+	}
+	out := &imageInfo{tag: tag, id: img.ID}
+	for _, d := range img.RepoDigests {
+		out.repoDigests = append(out.repoDigests, canonicalImage(d))
+	}
+	return out, nil
+}
+
+// refs returns the references the image can be used with by pods: its tag,
+// its repo digests and its ID.
+func (img *imageInfo) refs() []string {
+	return append([]string{img.tag, img.id}, img.repoDigests...)
+}
+
+// matches compares the ImageID reported in a container status with the image.
+// Locally built images are reported with their ID (such as
+// "docker://sha256:..."), while pulled images are reported with one of their
+// repo digests (such as "docker-pullable://IMAGE@sha256:...").
+func (img *imageInfo) matches(statusID string) bool {
+	ref := statusImageRef(statusID)
+	if ref == "" {
+		return false
+	}
+	if ref == img.id {
+		return true
+	}
+	for _, d := range img.repoDigests {
+		if d == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// statusImageRef returns the reference in the ImageID reported in a container
+// status in canonical form, which is either an image ID ("sha256:...") or a
+// repo digest ("docker.io/library/IMAGE@sha256:...").
+func statusImageRef(statusID string) string {
+	if i := strings.Index(statusID, "://"); i >= 0 {
+		statusID = statusID[i+len("://"):]
+	}
+	if statusID == "" {
+		return ""
+	}
+	return canonicalImage(normalizeImageID(statusID))
+}
+
+// normalizeImageID adds the "sha256:" prefix to the image IDs reported
+// without it (such as by CRI-O), so they compare equal to the ones of other
+// runtimes. Other references are returned as is.
+func normalizeImageID(id string) string {
+	if len(id) != 64 {
+		return id
+	}
+	for _, c := range id {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return id
+		}
+	}
+	return "sha256:" + id
+}
+
+// imageState reports whether any container or init container of the pod using
+// the image (by its tag, repo digest or ID) runs another image (older), and
+// whether any of them has not reported the image it runs yet (unknown). The
+// containers that have opted out of restarts are left out.
+func imageState(p *corev1.Pod, img *imageInfo) (older, unknown bool) {
+	refs := make(map[string]bool)
+	for _, ref := range img.refs() {
+		refs[ref] = true
+	}
+	ignored := ignoredContainers(p)
+	check := func(containers []corev1.Container, statuses []corev1.ContainerStatus) {
+		reported := make(map[string]corev1.ContainerStatus)
+		for _, cs := range statuses {
+			reported[cs.Name] = cs
+		}
+		for _, c := range containers {
+			if ignored[c.Name] {
+				continue
+			}
+			cs, ok := reported[c.Name]
+			if !refs[canonicalImage(c.Image)] && !(ok && refs[statusImageRef(cs.ImageID)]) {
+				continue
+			}
+			if !ok || cs.ImageID == "" {
+				unknown = true
+			} else if !img.matches(cs.ImageID) {
+				older = true
+			}
+		}
+	}
+	check(p.Spec.InitContainers, p.Status.InitContainerStatuses)
+	check(p.Spec.Containers, p.Status.ContainerStatuses)
+	return older, unknown
+}
+
+// isTag reports whether the canonical image reference refers to an image by
+// its tag, rather than by its repo digest or ID.
+func isTag(ref string) bool {
+	if strings.HasPrefix(ref, "sha256:") {
+		return false
+	}
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return false
+	}
+	_, ok := named.(reference.NamedTagged)
+	return ok
+}
+
+// canonicalImage normalizes the image reference to its fully qualified form,
+// such as "docker.io/library/nginx:latest", so that the equivalent references
+// to an image (like "nginx" and "index.docker.io/library/nginx:latest") match.
+// References without a tag get the "latest" tag, and references with both a
+// tag and a digest are reduced to the digest. Invalid references are returned
+// as is, and so are image IDs.
+func canonicalImage(img string) string {
+	if strings.HasPrefix(img, "sha256:") {
+		return img
+	}
+	named, err := reference.ParseNormalizedNamed(img)
+	if err != nil {
+		return img
+	}
+	if c, ok := named.(reference.Canonical); ok {
+		if withDigest, err := reference.WithDigest(reference.TrimNamed(named), c.Digest()); err == nil {
+			return withDigest.String()
+		}
+	}
+	return reference.TagNameOnly(named).String()
+}
@@ -0,0 +1,160 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	testOldID  = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	testNewID  = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	testTag    = "docker.io/library/app:latest"
+)
+
+// testImage is the image testTag points to, pulled with testDigest.
+var testImage = &imageInfo{tag: testTag, id: testNewID, repoDigests: []string{"docker.io/library/app@" + testDigest}}
+
+// testPod returns a pod running the image in a container, or an init
+// container, named "c" that reported the image ID, unless it's "-".
+func testPod(image, imageID string, init bool, annotations map[string]string) *corev1.Pod {
+	p := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "p", Annotations: annotations}}
+	c := corev1.Container{Name: "c", Image: image}
+	var statuses []corev1.ContainerStatus
+	if imageID != "-" {
+		statuses = []corev1.ContainerStatus{{Name: "c", Image: image, ImageID: imageID}}
+	}
+	if init {
+		p.Spec.InitContainers = []corev1.Container{c}
+		p.Status.InitContainerStatuses = statuses
+	} else {
+		p.Spec.Containers = []corev1.Container{c}
+		p.Status.ContainerStatuses = statuses
+	}
+	return p
+}
+
+func TestCanonicalImage(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"nginx", "docker.io/library/nginx:latest"},
+		{"nginx:1.13", "docker.io/library/nginx:1.13"},
+		{"library/nginx", "docker.io/library/nginx:latest"},
+		{"index.docker.io/library/nginx", "docker.io/library/nginx:latest"},
+		{"docker.io/library/nginx:latest", "docker.io/library/nginx:latest"},
+		{"localhost:5000/app", "localhost:5000/app:latest"},
+		{"localhost:5000/app:dev", "localhost:5000/app:dev"},
+		{"gcr.io/project/app:v1", "gcr.io/project/app:v1"},
+		{"nginx@" + testDigest, "docker.io/library/nginx@" + testDigest},
+		{"nginx:1.13@" + testDigest, "docker.io/library/nginx@" + testDigest},
+		{testDigest, testDigest},
+		{"Invalid:Ref", "Invalid:Ref"},
+	}
+	for _, tt := range tests {
+		if got := canonicalImage(tt.in); got != tt.want {
+			t.Errorf("canonicalImage(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestIsTag(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"docker.io/library/nginx:latest", true},
+		{"nginx:1.13", true},
+		{"localhost:5000/app:dev", true},
+		{"localhost:5000/app", false},
+		{"nginx", false},
+		{"nginx@" + testDigest, false},
+		{"nginx:1.13@" + testDigest, true},
+		{testDigest, false},
+		{"Invalid:Ref", false},
+	}
+	for _, tt := range tests {
+		if got := isTag(tt.in); got != tt.want {
+			t.Errorf("isTag(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestImageState(t *testing.T) {
+	ignored := map[string]string{ignoreContainersAnnotation: "sidecar, c"}
+	tests := []struct {
+		name                   string
+		pod                    *corev1.Pod
+		wantOlder, wantUnknown bool
+	}{
+		{"same id", testPod("app", "docker://"+testNewID, false, nil), false, false},
+		{"older id", testPod("app", "docker://"+testOldID, false, nil), true, false},
+		{"id without prefix", testPod("app:latest", testNewID[len("sha256:"):], false, nil), false, false},
+		{"same repo digest", testPod("app", "docker-pullable://app@"+testDigest, false, nil), false, false},
+		{"older repo digest", testPod("app", "docker-pullable://app@"+testOldID, false, nil), true, false},
+		{"by digest", testPod("app@"+testDigest, "docker-pullable://app@"+testDigest, false, nil), false, false},
+		{"by id", testPod(testNewID, "docker://"+testNewID, false, nil), false, false},
+		{"no status", testPod("app", "-", false, nil), false, true},
+		{"no image id", testPod("app", "", false, nil), false, true},
+		{"older init container", testPod("app", "docker://"+testOldID, true, nil), true, false},
+		{"unknown init container", testPod("app", "-", true, nil), false, true},
+		{"ignored container", testPod("app", "docker://"+testOldID, false, ignored), false, false},
+		{"other image", testPod("other", "docker://"+testOldID, false, nil), false, false},
+	}
+	for _, tt := range tests {
+		older, unknown := imageState(tt.pod, testImage)
+		if older != tt.wantOlder || unknown != tt.wantUnknown {
+			t.Errorf("%s: imageState() = %v, %v, want %v, %v", tt.name, older, unknown, tt.wantOlder, tt.wantUnknown)
+		}
+	}
+}
+
+func TestOutdatedImages(t *testing.T) {
+	resolved := map[string]*imageInfo{testTag: testImage}
+	tests := []struct {
+		name       string
+		pod        *corev1.Pod
+		kind       containerKind
+		images     map[string]*imageInfo
+		created    map[string]bool
+		staleCheck bool
+		want       bool
+	}{
+		{"up to date", testPod("app", "docker://"+testNewID, false, nil), regularContainer, resolved, nil, false, false},
+		{"older", testPod("app", "docker://"+testOldID, false, nil), regularContainer, resolved, nil, false, true},
+		{"older init container", testPod("app", "docker://"+testOldID, true, nil), initContainer, resolved, nil, false, true},
+		{"older on stale check", testPod("app", "docker://"+testOldID, false, nil), regularContainer, resolved, nil, true, true},
+		{"unresolved", testPod("app", "docker://"+testNewID, false, nil), regularContainer, nil, nil, false, true},
+		{"unresolved on stale check", testPod("app", "docker://"+testNewID, false, nil), regularContainer, nil, nil, true, false},
+		{"unknown", testPod("app", "-", false, nil), regularContainer, resolved, nil, false, true},
+		{"unknown on stale check", testPod("app", "-", false, nil), regularContainer, resolved, nil, true, false},
+		{"unknown for created tag", testPod("app", "", false, nil), regularContainer, resolved, map[string]bool{testTag: true}, false, false},
+		{"older for created tag", testPod("app", "docker://"+testOldID, false, nil), regularContainer, resolved, map[string]bool{testTag: true}, false, true},
+	}
+	for _, tt := range tests {
+		want := map[string]containerKind{}
+		if tt.want {
+			want[testTag] = tt.kind
+		}
+		got := outdatedImages(tt.pod, map[string]containerKind{testTag: tt.kind}, tt.images, tt.created, tt.staleCheck)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: outdatedImages() = %v, want %v", tt.name, got, want)
+		}
+	}
+}
@@ -30,26 +30,30 @@ func isInCluster() bool {
 }
 
 // kubernetesClient loads a Kubernetes client using in-cluster configuration if
-// it detects it's running inside the cluster. Otherwise it uses the default
-// loading rules, such as the well-known path and the environment variable.
-func kubernetesClient() (*kubernetes.Clientset, error) {
+// it detects it's running inside the cluster and no kubeconfig or context is
+// specified. Otherwise it uses the specified kubeconfig file, or the default
+// loading rules (such as the well-known path and the environment variable),
+// and the specified context, or the current one. It also returns the config
+// of the client, to create the clients of the API groups the client lacks.
+func kubernetesClient(kubeconfig, context string) (*kubernetes.Clientset, *rest.Config, error) {
 	var config *rest.Config
 	var err error
-	if isInCluster() {
+	if kubeconfig == "" && context == "" && isInCluster() {
 		config, err = rest.InClusterConfig()
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to load in-cluster config")
+			return nil, nil, errors.Wrap(err, "failed to load in-cluster config")
 		}
 	} else {
 		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+		loadingRules.ExplicitPath = kubeconfig
 		kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules,
-			&clientcmd.ConfigOverrides{})
+			&clientcmd.ConfigOverrides{CurrentContext: context})
 		config, err = kubeConfig.ClientConfig()
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to load the kube config")
+			return nil, nil, errors.Wrap(err, "failed to load the kube config")
 		}
 	}
 
 	clients, err := kubernetes.NewForConfig(config)
-	return clients, errors.Wrap(err, "cannot initialize a kubernetes client with loaded configuration")
+	return clients, config, errors.Wrap(err, "cannot initialize a kubernetes client with loaded configuration")
 }
@@ -0,0 +1,125 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	coordinationv1typed "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	leaseDuration = time.Second * 15
+	renewDeadline = time.Second * 10
+	retryPeriod   = time.Second * 2
+)
+
+func init() {
+	// the clientset predates the coordination.k8s.io API group, whose
+	// objects must be known to its scheme to be decoded and referred to by
+	// events.
+	if err := coordinationv1.AddToScheme(scheme.Scheme); err != nil {
+		panic(err)
+	}
+}
+
+// runAsLeader runs the function once this instance is elected as the leader
+// among the freshpod replicas, and until the context is cancelled. The lease is
+// held on the Lease (or, on clusters older than Kubernetes 1.14, the ConfigMap)
+// set in the config. It returns an error if the leadership is lost, because
+// run can no longer be trusted to be the only one running. When the context
+// is cancelled while leading, it waits for run to return, and the lease keeps
+// being renewed until then so that no other replica takes over before run has
+// wound down.
+func runAsLeader(ctx context.Context, k8s kubernetes.Interface, restConfig *rest.Config, recorder record.EventRecorder, cfg *config, run func(context.Context)) error {
+	id, err := os.Hostname()
+	if err != nil {
+		return errors.Wrap(err, "failed to determine the leader election identity")
+	}
+	coordination, err := coordinationv1typed.NewForConfig(restConfig)
+	if err != nil {
+		return errors.Wrap(err, "failed to create the coordination client")
+	}
+	lock, err := resourcelock.New(cfg.LeaderElectResourceLock, cfg.LeaderElectNamespace, cfg.LeaderElectName,
+		k8s.CoreV1(), coordination, resourcelock.ResourceLockConfig{
+			Identity:      id,
+			EventRecorder: recorder,
+		})
+	if err != nil {
+		return errors.Wrap(err, "failed to create the leader election lock")
+	}
+
+	lost := make(chan struct{})
+	leading := make(chan struct{})
+	finished := make(chan struct{})
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: leaseDuration,
+		RenewDeadline: renewDeadline,
+		RetryPeriod:   retryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(stop <-chan struct{}) {
+				close(leading)
+				defer close(finished)
+				logEvent("leader_elected").with("identity", id).info()
+				leaderCtx, cancel := context.WithCancel(ctx)
+				defer cancel()
+				go func() {
+					<-stop
+					cancel()
+				}()
+				run(leaderCtx)
+			},
+			OnStoppedLeading: func() {
+				close(lost)
+			},
+			OnNewLeader: func(identity string) {
+				logEvent("leader_observed").with("identity", identity).info()
+			},
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create leader elector")
+	}
+
+	logEvent("leader_election").with("identity", id).
+		msg("waiting for the lease on %s %s", cfg.LeaderElectResourceLock, lock.Describe()).info()
+	go le.Run()
+	select {
+	case <-ctx.Done():
+		select {
+		case <-leading:
+		default:
+			return nil
+		}
+		select {
+		case <-finished:
+			return nil
+		case <-lost:
+			return errors.New("lost the leader election lease while shutting down")
+		}
+	case <-lost:
+		return errors.New("lost the leader election lease")
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+func (l logLevel) String() string { return logLevelNames[l] }
+
+// parseLogLevel returns the level with the specified name.
+func parseLogLevel(s string) (logLevel, error) {
+	for l, name := range logLevelNames {
+		if name == s {
+			return l, nil
+		}
+	}
+	return 0, errors.Errorf("unknown log level %q", s)
+}
+
+const (
+	logFormatLogfmt = "logfmt"
+	logFormatJSON   = "json"
+)
+
+// logger writes log records of at least its level in the configured format.
+type logger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	level  logLevel
+	format string
+}
+
+// stdLogger is the logger used by logEvent records.
+var stdLogger = &logger{out: os.Stderr, level: levelInfo, format: logFormatLogfmt}
+
+// configureLogging sets the level and the format (logfmt or json) of the
+// log records.
+func configureLogging(level, format string) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	if format != logFormatLogfmt && format != logFormatJSON {
+		return errors.Errorf("unknown log format %q", format)
+	}
+	stdLogger.mu.Lock()
+	stdLogger.level = l
+	stdLogger.format = format
+	stdLogger.mu.Unlock()
+	return nil
+}
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// logRecord is a log record under construction. Every record has an event
+// name, such as "deleted_pod", and fields with stable keys, so the logs can be
+// filtered and aggregated reliably.
+type logRecord struct {
+	event  string
+	fields []logField
+}
+
+// logEvent starts a log record of the event. The record is written with one
+// of its level methods, such as info().
+func logEvent(event string) *logRecord {
+	return &logRecord{event: event}
+}
+
+// with adds a field to the record.
+func (r *logRecord) with(key string, value interface{}) *logRecord {
+	r.fields = append(r.fields, logField{key, value})
+	return r
+}
+
+func (r *logRecord) image(ref string) *logRecord { return r.with("image", ref) }
+
+func (r *logRecord) pod(namespace, name string) *logRecord {
+	return r.with("namespace", namespace).with("pod", name)
+}
+
+// owner adds the workload managing the pod the record is about, such as
+// "ReplicaSet/web-5d8f7", unless it's empty.
+func (r *logRecord) owner(owner string) *logRecord {
+	if owner == "" {
+		return r
+	}
+	return r.with("owner", owner)
+}
+
+// target adds the pod or the workload being restarted.
+func (r *logRecord) target(w workload) *logRecord {
+	if w.kind == "Pod" {
+		return r.pod(w.namespace, w.name)
+	}
+	return r.with("namespace", w.namespace).owner(w.kind + "/" + w.name)
+}
+
+// trigger adds the ID of the batch of tag events (or of the stale check) that
+// led to the event, unless it's empty.
+func (r *logRecord) trigger(id string) *logRecord {
+	if id == "" {
+		return r
+	}
+	return r.with("trigger", id)
+}
+
+// err adds the error, unless it's nil.
+func (r *logRecord) err(err error) *logRecord {
+	if err == nil {
+		return r
+	}
+	return r.with("error", err)
+}
+
+func (r *logRecord) msg(format string, args ...interface{}) *logRecord {
+	return r.with("msg", fmt.Sprintf(format, args...))
+}
+
+func (r *logRecord) debug() { stdLogger.write(levelDebug, r) }
+func (r *logRecord) info()  { stdLogger.write(levelInfo, r) }
+func (r *logRecord) warn()  { stdLogger.write(levelWarn, r) }
+func (r *logRecord) error() { stdLogger.write(levelError, r) }
+
+// fatal writes the record at the error level and exits.
+func (r *logRecord) fatal() {
+	stdLogger.write(levelError, r)
+	os.Exit(1)
+}
+
+func (l *logger) write(level logLevel, r *logRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if level < l.level {
+		return
+	}
+	fields := append([]logField{
+		{"ts", time.Now().UTC().Format(time.RFC3339Nano)},
+		{"level", level.String()},
+		{"event", r.event},
+	}, r.fields...)
+
+	var b bytes.Buffer
+	if l.format == logFormatJSON {
+		b.WriteByte('{')
+		for i, f := range fields {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			k, _ := json.Marshal(f.key)
+			v, err := json.Marshal(logValue(f.value))
+			if err != nil {
+				v, _ = json.Marshal(fmt.Sprint(f.value))
+			}
+			b.Write(k)
+			b.WriteByte(':')
+			b.Write(v)
+		}
+		b.WriteByte('}')
+	} else {
+		for i, f := range fields {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(f.key)
+			b.WriteByte('=')
+			b.WriteString(logfmtValue(fmt.Sprint(logValue(f.value))))
+		}
+	}
+	b.WriteByte('\n')
+	l.out.Write(b.Bytes())
+}
+
+// logValue converts the value of a field to a string, unless it's a number or
+// a boolean.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string, bool, int, int64, float64:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// logfmtValue quotes the value if it's empty or contains spaces, quotes, equal
+// signs or non-printable characters.
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"") || strconv.Quote(s) != `"`+s+`"` {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// newTriggerID returns a random ID for correlating the log records of the
+// restarts with the tag events (or the stale check) causing them.
+func newTriggerID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
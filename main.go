@@ -15,16 +15,16 @@ package main
 
 import (
 	"context"
-	"log"
+	"flag"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/filters"
-	dockerclient "github.com/docker/docker/client"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/client-go/kubernetes"
@@ -33,92 +33,187 @@ import (
 )
 
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
+	sources, err := parseConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		logEvent("invalid_config").err(err).fatal()
+	}
+	cfg, err := sources.build(nil)
+	if err != nil {
+		logEvent("invalid_config").err(err).fatal()
+	}
+	// the ConfigMap is read with the kubeconfig and context of the config
+	// file and flags, and applied before anything runs so that its static
+	// keys take effect too.
+	k8s, restConfig, err := kubernetesClient(cfg.Kubeconfig, cfg.Context)
+	if err != nil {
+		logEvent("startup_failed").err(err).fatal()
+	}
+	var configMap []byte
+	if sources.configMap != "" {
+		parts := strings.Split(sources.configMap, "/")
+		if configMap, err = readConfigMap(k8s, parts[0], parts[1]); err != nil {
+			logEvent("startup_failed").err(err).fatal()
+		}
+		if cfg, err = sources.build(configMap); err != nil {
+			logEvent("invalid_config").err(err).fatal()
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		logEvent("invalid_config").err(err).fatal()
+	}
+	if err := configureLogging(cfg.LogLevel, cfg.LogFormat); err != nil {
+		logEvent("invalid_config").err(err).fatal()
+	}
+
+	// cancelling ctx stops accepting image events and drains the restarts,
+	// after which stopInformers stops the informers and the other background
+	// work running on informerCtx.
+	informerCtx, stopInformers := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(informerCtx)
 
 	go func() {
 		signalChan := make(chan os.Signal, 1)
 		signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 		sig := <-signalChan
-		log.Printf("received signal: %s", sig.String())
+		logEvent("signal_received").with("signal", sig.String()).msg("shutting down").info()
 		cancel()
+		sig = <-signalChan
+		logEvent("signal_received").with("signal", sig.String()).msg("exiting without draining").error()
+		os.Exit(1)
 	}()
 
-	tagEvent := filters.NewArgs()
-	tagEvent.Add("type", "image")
-	tagEvent.Add("event", "tag")
-
-	k8s, err := kubernetesClient()
-	if err != nil {
-		log.Fatal(err)
-	}
 	k8sv, err := k8s.ServerVersion()
 	if err != nil {
-		log.Fatal("failed to connect to kubernetes")
+		logEvent("startup_failed").err(errors.Wrap(err, "failed to connect to kubernetes")).fatal()
 	}
-	log.Printf("connected kubernetes apiserver (%s)", k8sv.GitVersion)
+	logEvent("kubernetes_connected").with("version", k8sv.GitVersion).info()
 
-	d, err := dockerclient.NewEnvClient()
+	// the image changes reported by the event sources trigger the restarts,
+	// and the image store of the runtime tells which image the tags point to.
+	images, err := newImageResolver(ctx, cfg)
+	if err != nil {
+		logEvent("startup_failed").err(err).fatal()
+	}
+	imageSources, err := newEventSources(ctx, cfg)
 	if err != nil {
-		log.Fatal(errors.Wrap(err, "cannot create docker client"))
+		logEvent("startup_failed").err(err).fatal()
 	}
-	d.NegotiateAPIVersion(ctx)
-	dv, err := d.ServerVersion(ctx)
+	// the runtime also stops the containers restarted in place.
+	containers, err := newContainerStopper(ctx, cfg)
 	if err != nil {
-		log.Fatal(errors.Wrap(err, "failed to connect to docker api"))
-	}
-	log.Printf("connected docker api (api: v%s, version: %s)", dv.APIVersion, dv.Version)
-
-	podHandler := &podDeletionHandler{pods: newRegistry()}
-	tagCh := podHandler.Start(ctx, k8s.CoreV1())
-
-	podWatcher := podWatchController(k8s, podHandler)
-	go podWatcher.Run(ctx.Done())
-
-	ch, errCh := d.Events(ctx, types.EventsOptions{Filters: tagEvent})
-	for {
-		select {
-		case err := <-errCh:
-			select {
-			case <-ctx.Done():
-				log.Println("stopping event listener due to cancellation")
-				os.Exit(0)
-			default:
-				panic(err) // TODO(ahmetb) handle gracefully
-			}
-
-		case e := <-ch:
-			// tag will be in format IMAGE:TAG or IMAGE:latest as it comes
-			// from the Docker API (v1.32 at the time of writing).
-			tag := e.Actor.Attributes["name"]
-			tagCh <- tag
-		case <-ctx.Done():
-			break
+		logEvent("startup_failed").err(err).fatal()
+	}
+
+	live := newLiveConfig(cfg)
+	recorder := newEventRecorder(k8s)
+	podHandler := &podDeletionHandler{
+		pods:       newRegistry(),
+		images:     images,
+		containers: containers,
+		config:     live,
+		recorder:   recorder,
+	}
+
+	podWatchers := newPodWatchers(informerCtx, k8s, cfg.InformerResync.Duration, podHandler)
+	podWatchers.setNamespaces(cfg.Namespaces)
+	hasSynced := podWatchers.HasSynced
+	go podHandler.Resync(informerCtx, podWatchers, hasSynced, cfg.ResyncInterval.Duration)
+
+	live.subscribe(func(cfg *config) {
+		if err := configureLogging(cfg.LogLevel, cfg.LogFormat); err != nil {
+			logEvent("invalid_config").err(err).error()
 		}
+		podWatchers.setNamespaces(cfg.Namespaces)
+	})
+	reloader := &configReloader{sources: sources, live: live, configMap: configMap}
+	go reloader.reloadOnSignal(informerCtx)
+	if sources.configMap != "" {
+		parts := strings.Split(sources.configMap, "/")
+		go reloader.watchConfigMap(informerCtx, k8s, parts[0], parts[1])
+	}
+
+	registerStateMetrics(podHandler.pods, hasSynced)
+	if cfg.HTTPAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			mux.Handle("/healthz", healthzHandler(&podHandler.health, live))
+			mux.Handle("/readyz", readyzHandler(&podHandler.health, hasSynced, sourceStatuses(imageSources)))
+			logEvent("http_serving").with("addr", cfg.HTTPAddr).msg("serving metrics and health checks").info()
+			logEvent("http_failed").err(errors.Wrap(http.ListenAndServe(cfg.HTTPAddr, mux), "http server failed")).fatal()
+		}()
+	}
+
+	// the pod informers above keep running on the standby replicas, so they
+	// are ready to take over as soon as they are elected.
+	var drainErr error
+	run := func(ctx context.Context) {
+		events := podHandler.Start(ctx, k8s)
+		go podHandler.CheckStale(ctx, k8s, hasSynced, cfg.StaleCheckInterval.Duration)
+
+		runEventSources(ctx, imageSources, events)
+		logEvent("event_sources_stopped").msg("stopping event sources due to cancellation").info()
+		drainErr = podHandler.Drain(live.get().ShutdownTimeout.Duration)
 	}
+	if !cfg.LeaderElect {
+		run(ctx)
+	} else if err := runAsLeader(ctx, k8s, restConfig, recorder, cfg, run); err != nil {
+		logEvent("leader_election_failed").err(err).fatal()
+	}
+
+	stopInformers()
+	if drainErr != nil {
+		logEvent("shutdown_incomplete").err(drainErr).fatal()
+	}
+	logEvent("shutdown_complete").info()
 }
 
-func podWatchController(k8s *kubernetes.Clientset, pods *podDeletionHandler) cache.Controller {
+func podWatchController(k8s *kubernetes.Clientset, namespace string, resync time.Duration, pods *podDeletionHandler) (cache.Store, cache.Controller) {
 	restClient := k8s.CoreV1().RESTClient()
-	lw := cache.NewListWatchFromClient(restClient, "pods", corev1.NamespaceAll, fields.Everything())
-	_, controller := cache.NewInformer(lw,
+	lw := cache.NewListWatchFromClient(restClient, "pods", namespace, fields.Everything())
+	return cache.NewInformer(lw,
 		&corev1.Pod{},
-		time.Second*5,
+		resync,
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
 				pod, ok := obj.(*corev1.Pod)
 				if !ok {
-					log.Fatalf("list/watch returned non-pod object: %T", obj)
+					logEvent("unexpected_object").msg("list/watch returned non-pod object: %T", obj).warn()
+					return
 				}
 				pods.Track(pod)
 			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldPod, ok := oldObj.(*corev1.Pod)
+				if !ok {
+					logEvent("unexpected_object").msg("list/watch returned non-pod object: %T", oldObj).warn()
+					return
+				}
+				newPod, ok := newObj.(*corev1.Pod)
+				if !ok {
+					logEvent("unexpected_object").msg("list/watch returned non-pod object: %T", newObj).warn()
+					return
+				}
+				pods.Retrack(oldPod, newPod)
+			},
 			DeleteFunc: func(obj interface{}) {
 				pod, ok := obj.(*corev1.Pod)
 				if !ok {
-					log.Fatalf("list/watch returned non-pod object: %T", obj)
+					// the watch missed the deletion, the informer gives us
+					// the last known state of the pod instead.
+					tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+					if !ok {
+						logEvent("unexpected_object").msg("list/watch returned non-pod object: %T", obj).warn()
+						return
+					}
+					pod, ok = tombstone.Obj.(*corev1.Pod)
+					if !ok {
+						logEvent("unexpected_object").msg("tombstone contained non-pod object: %T", tombstone.Obj).warn()
+						return
+					}
 				}
 				pods.Untrack(pod)
 			},
 		},
 	)
-	return controller
 }
@@ -0,0 +1,111 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/tools/cache"
+)
+
+const metricsNamespace = "freshpod"
+
+var (
+	tagEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tag_events_total",
+		Help:      "Number of image tag events received, by event source.",
+	}, []string{"source"})
+	podDeletionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pod_deletions_total",
+		Help:      "Number of pod deletions by namespace and result (deleted or failed).",
+	}, []string{"namespace", "result"})
+	restartsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "restarts_total",
+		Help:      "Number of restarts of pods and workloads by kind, namespace and final result (succeeded, skipped, failed or abandoned on shutdown).",
+	}, []string{"kind", "namespace", "result"})
+	restartRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "restart_retries_total",
+		Help:      "Number of restarts of pods and workloads retried after a transient error.",
+	}, []string{"kind", "namespace"})
+	restartLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "tag_to_restart_seconds",
+		Help:      "Time from receiving an image tag event to finishing the restart of a pod or workload using it.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+	evictionsBlockedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "evictions_blocked_total",
+		Help:      "Number of pod evictions refused because of a PodDisruptionBudget, by namespace.",
+	}, []string{"namespace"})
+	blockedEvictions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "blocked_evictions",
+		Help:      "Number of pods whose eviction is blocked by a PodDisruptionBudget and being retried, by namespace.",
+	}, []string{"namespace"})
+	eventSourceReconnectsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "event_source_reconnects_total",
+		Help:      "Number of times an event source lost the connection to what it watches (such as the docker event stream), by source.",
+	}, []string{"source"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		tagEventsTotal,
+		podDeletionsTotal,
+		restartsTotal,
+		restartRetriesTotal,
+		restartLatency,
+		evictionsBlockedTotal,
+		blockedEvictions,
+		eventSourceReconnectsTotal,
+	)
+}
+
+// registerStateMetrics registers the metrics reporting the size of the
+// registry and whether the pod informer has synced.
+func registerStateMetrics(pods *podRegistry, hasSynced cache.InformerSynced) {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "tracked_images",
+			Help:      "Number of images used by the tracked pods.",
+		}, func() float64 {
+			images, _ := pods.size()
+			return float64(images)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "tracked_pods",
+			Help:      "Number of tracked pods.",
+		}, func() float64 {
+			_, n := pods.size()
+			return float64(n)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "pod_informer_synced",
+			Help:      "Whether the pod informer has synced (1) or not (0).",
+		}, func() float64 {
+			if hasSynced() {
+				return 1
+			}
+			return 0
+		}),
+	)
+}
@@ -16,94 +16,546 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
-	corev1typed "k8s.io/client-go/kubernetes/typed/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// staleRestart restarts the pods found running an older image by the
+	// stale checks.
+	staleRestart = "restart"
+	// staleReport only logs the pods found running an older image by the
+	// stale checks.
+	staleReport = "report"
 )
 
 type podDeletionHandler struct {
-	pods *podRegistry
+	pods   *podRegistry
+	images imageResolver
+	// containers stops the containers restarted in place, if set.
+	containers containerStopper
+	// config holds the restart mode, stale action, debounce window and the
+	// other settings of the handler, which can change on reloads.
+	config *liveConfig
+
+	queue   workqueue.RateLimitingInterface
+	tasksMu sync.Mutex
+	tasks   map[workload]*restartTask
+	health  handlerHealth
 
-	tagCh chan string
-	mu    sync.Mutex
+	// recorder posts Kubernetes events on the restarted pods and their
+	// owners, if set.
+	recorder record.EventRecorder
+
+	events chan imageEvent
+	mu     sync.Mutex
+
+	// loopDone is closed when the event loop returns. batches tracks the tag
+	// events being turned into restarts and workers the restart workers, so
+	// they can be drained on shutdown.
+	loopDone chan struct{}
+	batches  sync.WaitGroup
+	workers  sync.WaitGroup
+	// work is the context of the image lookups of tag events and of the
+	// containers being stopped, which outlives the context the handler is
+	// started with so that the events received before shutdown are still
+	// handled. It's cancelled when draining times out.
+	work       context.Context
+	cancelWork context.CancelFunc
 }
 
-// Start returns a chan where image tags can be provided for deletion of pods
-// running them and starts a goroutine for deletion in the background.
-func (h *podDeletionHandler) Start(ctx context.Context, k8s corev1typed.CoreV1Interface) chan<- string {
+// Start returns a chan where the event sources report the image changes
+// triggering the deletion of pods running the changed tags, and starts the
+// workers restarting them in the background. Changes received within the
+// debounce window of the first one are handled together, so that pods using
+// several of the rebuilt images are restarted only once.
+func (h *podDeletionHandler) Start(ctx context.Context, k8s kubernetes.Interface) chan<- imageEvent {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	if h.tagCh != nil {
+	if h.events != nil {
 		panic("pod deletion handler is already started")
 	}
-	h.tagCh = make(chan string)
+	h.events = make(chan imageEvent)
+	h.queue = newRestartQueue()
+	h.tasks = make(map[workload]*restartTask)
+	h.health.start()
+	h.loopDone = make(chan struct{})
+	h.work, h.cancelWork = context.WithCancel(context.Background())
+	for i := 0; i < h.config.get().Concurrency; i++ {
+		h.workers.Add(1)
+		go func() {
+			defer h.workers.Done()
+			h.runWorker(k8s)
+		}()
+	}
 
 	go func() {
+		defer close(h.loopDone)
+		// pending holds the tags of the batch, and whether all of their
+		// changes created them.
+		pending := make(map[string]bool)
+		var receivedAt time.Time
+		var trigger string
+		var flush <-chan time.Time
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		// flushPending turns the pending tags into restarts in the
+		// background, tracked by batches so they can be drained.
+		flushPending := func() {
+			tags := make([]string, 0, len(pending))
+			for tag := range pending {
+				tags = append(tags, tag)
+			}
+			sort.Strings(tags)
+			created := pending
+			pending = make(map[string]bool)
+			flush = nil
+			h.batches.Add(1)
+			go func(trigger string, receivedAt time.Time) {
+				defer h.batches.Done()
+				h.deletePods(h.work, k8s, tags, created, trigger, receivedAt, false)
+			}(trigger, receivedAt)
+		}
 		for {
+			h.health.beat()
 			select {
 			case <-ctx.Done():
+				if len(pending) > 0 {
+					logEvent("flushing_tags").trigger(trigger).with("count", len(pending)).
+						msg("shutting down before the end of the debounce window").info()
+					flushPending()
+				}
 				return
-			case tag := <-h.tagCh:
-				log.Printf("[image_tagged] %q", tag)
-				go h.deletePods(k8s, tag)
+			case <-heartbeat.C:
+			case ev := <-h.events:
+				tagEventsTotal.WithLabelValues(ev.source).Inc()
+				tag := canonicalImage(ev.ref)
+				if ev.newID != "" && ev.newID == ev.oldID {
+					logEvent("image_unchanged").image(tag).with("source", ev.source).with("id", ev.newID).debug()
+					continue
+				}
+				if len(pending) == 0 {
+					trigger = newTriggerID()
+					receivedAt = time.Now()
+					flush = time.After(h.config.get().Debounce.Duration)
+				}
+				logEvent("image_tagged").image(tag).trigger(trigger).with("source", ev.source).
+					with("node", ev.node).with("old_id", ev.oldID).with("new_id", ev.newID).info()
+				if c, ok := pending[tag]; ok {
+					pending[tag] = c && ev.created
+				} else {
+					pending[tag] = ev.created
+				}
+			case <-flush:
+				flushPending()
 			}
 		}
 	}()
-	return h.tagCh
+	return h.events
 }
 
-// deletePods deletes pods running the specified tag serially.
-func (h *podDeletionHandler) deletePods(k8s corev1typed.CoreV1Interface, tag string) {
-	pods := h.pods.get(tag)
+// Drain shuts the handler down once the context it was started with is
+// cancelled: it waits for the tag events already received, including the ones
+// still in the debounce window, to be turned into restarts, and for the queued
+// and in-flight restarts to finish. The restarts waiting to be retried when
+// the queue shuts down are abandoned. It returns an error if any restart was
+// abandoned, or if they don't finish within the timeout, in which case the
+// remaining restarts are abandoned as well.
+func (h *podDeletionHandler) Drain(timeout time.Duration) error {
+	h.mu.Lock()
+	started := h.events != nil
+	h.mu.Unlock()
+	if !started {
+		return nil
+	}
+	deadline := time.After(timeout)
+	logEvent("draining").with("timeout", timeout).info()
+
+	done := make(chan struct{})
+	go func() {
+		<-h.loopDone
+		h.batches.Wait()
+		// the workers process the restarts still queued before they return.
+		h.queue.ShutDown()
+		h.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		// the restarts waiting in the backoff of a retry never come back
+		// once the queue is shut down.
+		if n := h.abandonRestarts(errors.New("shutting down before retrying")); n > 0 {
+			return errors.Errorf("abandoned %d restarts waiting to be retried", n)
+		}
+		logEvent("drained").info()
+		return nil
+	case <-deadline:
+		h.cancelWork()
+		h.queue.ShutDown()
+		queued := h.abandonRestarts(errors.Errorf("shutdown timed out after %s", timeout))
+		err := errors.Errorf("timed out after %s draining restarts, abandoning %d queued", timeout, queued)
+		if inflight := h.health.inflightTargets(); len(inflight) > 0 {
+			err = errors.Wrapf(err, "restarts of %s still in flight", strings.Join(inflight, ", "))
+		}
+		return err
+	}
+}
+
+// deletePods schedules the restart of pods running an older image of any of
+// the specified tags, deciding once for each pod no matter how many of its
+// images were updated. Pods already running the images the tags point to are
+// left alone. Workloads restarted as a whole, such as with a rollout, are
+// restarted only once however many of their pods are outdated.
+//
+// created holds the tags whose changes all created them, such as the ones the
+// kubelet pulls for the pods starting up: the containers that haven't reported
+// the image they run yet are left alone for those.
+//
+// trigger identifies the batch of tag events (or the stale check) in the logs.
+// receivedAt is when the first of the tag events was received, if the restarts
+// were triggered by tag events.
+//
+// For stale checks, only the pods known to run an older image are restarted
+// (or reported, depending on the stale action), rather than every pod that
+// cannot be proven to be up-to-date.
+func (h *podDeletionHandler) deletePods(ctx context.Context, k8s kubernetes.Interface, tags []string, created map[string]bool, trigger string, receivedAt time.Time, staleCheck bool) {
+	// the whole batch is handled with the same config, even if it's reloaded
+	// in the meantime.
+	cfg := h.config.get()
+	scope, err := newPodScope(k8s, cfg)
+	if err != nil {
+		// the config is validated before it's used, so this doesn't happen.
+		logEvent("invalid_config").trigger(trigger).err(err).error()
+		return
+	}
+
+	// pods using any of the tags (or the repo digests and IDs of the images
+	// they point to), along with the kinds of containers using each tag.
+	pods := make(map[pod]map[string]containerKind)
+	images := make(map[string]*imageInfo)
+	for _, tag := range tags {
+		refs := []string{tag}
+		var img *imageInfo
+		if h.images == nil {
+			err = errors.New("no image resolver configured")
+		} else {
+			img, err = h.images.resolveImage(ctx, tag)
+		}
+		if err != nil {
+			if staleCheck {
+				logEvent("stale_check_skipped").image(tag).trigger(trigger).err(err).warn()
+				continue
+			}
+			// without the image ID we can't tell whether pods are
+			// up-to-date, so we restart all of them like we would do for a
+			// new image.
+			logEvent("image_unresolved").image(tag).trigger(trigger).err(err).warn()
+		} else {
+			images[tag] = img
+			refs = img.refs()
+		}
+
+		var matched bool
+		for _, ref := range refs {
+			for p, kind := range h.pods.get(ref) {
+				if pods[p] == nil {
+					pods[p] = make(map[string]containerKind)
+				}
+				pods[p][tag] |= kind
+				matched = true
+			}
+		}
+		if !matched && !staleCheck {
+			logEvent("noop").image(tag).trigger(trigger).msg("no pods registered with the image").info()
+		}
+	}
 	if len(pods) == 0 {
-		log.Printf("[noop] no pods registered with image=%s", tag)
 		return
 	}
-	for _, p := range pods {
-		log.Printf("[deleting_pod] %s/%s", p.namespace, p.name)
-		if err := k8s.Pods(p.namespace).Delete(p.name, nil); err != nil {
-			log.Println(errors.Wrap(err, "failed to delete pod"))
+
+	// workloads restarted as a whole are enqueued once the batch is done, so
+	// that they are restarted once no matter how many of their pods use the
+	// images. Otherwise a worker could take the restart of the workload off
+	// the queue before its next pod enqueues it again.
+	workloads := make(map[workload]*restartTask)
+	for p, podTags := range pods {
+		reason, err := scope.namespaceExcluded(p.namespace)
+		if err != nil {
+			logEvent("scope_check_failed").pod(p.namespace, p.name).trigger(trigger).err(err).error()
+			continue
+		} else if reason != "" {
+			logEvent("pod_out_of_scope").pod(p.namespace, p.name).trigger(trigger).with("reason", reason).debug()
+			continue
+		}
+
+		po, err := k8s.CoreV1().Pods(p.namespace).Get(p.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			logEvent("pod_gone").pod(p.namespace, p.name).trigger(trigger).info()
+			h.pods.set(p, nil)
+			continue
+		} else if err != nil {
+			// without the pod, we can't tell whether it opted out.
+			logEvent("pod_get_failed").pod(p.namespace, p.name).trigger(trigger).err(err).error()
+			continue
+		}
+		if reason := scope.podExcluded(po); reason != "" {
+			logEvent("pod_out_of_scope").pod(p.namespace, p.name).owner(podOwner(po)).trigger(trigger).
+				with("reason", reason).debug()
+			continue
+		}
+
+		outdated := outdatedImages(po, podTags, images, created, staleCheck)
+		if len(outdated) == 0 {
+			if !staleCheck {
+				logEvent("pod_up_to_date").pod(p.namespace, p.name).owner(podOwner(po)).trigger(trigger).
+					with("images", formatImages(podTags)).info()
+			}
+			continue
+		}
+		if staleCheck {
+			logEvent("stale_pod").pod(p.namespace, p.name).owner(podOwner(po)).trigger(trigger).
+				with("images", formatImages(outdated)).info()
+			if cfg.StaleAction == staleReport {
+				continue
+			}
+		}
+
+		owner, err := ownerOf(k8s.AppsV1(), po)
+		var ownerMeta metav1.Object
+		if err == nil {
+			ownerMeta, err = workloadMeta(k8s, owner)
+		}
+		if err != nil {
+			// the strategies restarting the pod itself can do without its
+			// owner, such as on clusters not serving the owner's API.
+			if _, ok := restarters[restartStrategy(cfg, po, nil)].target(po, nil, nil); !ok {
+				logEvent("owner_lookup_failed").pod(p.namespace, p.name).owner(podOwner(po)).trigger(trigger).err(err).error()
+				continue
+			}
+			logEvent("owner_lookup_failed").pod(p.namespace, p.name).owner(podOwner(po)).trigger(trigger).err(err).
+				msg("restarting the pod itself").warn()
+			owner, ownerMeta = nil, nil
+		} else if reason = scope.ownerExcluded(owner, ownerMeta); reason != "" {
+			logEvent("pod_out_of_scope").pod(p.namespace, p.name).owner(podOwner(po)).trigger(trigger).
+				with("reason", reason).info()
+			continue
+		}
+		strategy := restartStrategy(cfg, po, ownerMeta)
+		target, ok := restarters[strategy].target(po, owner, ownerMeta)
+		if !ok {
+			logEvent("restart_strategy_unsupported").pod(p.namespace, p.name).owner(podOwner(po)).trigger(trigger).
+				with("strategy", strategy).msg("deleting the pod instead").debug()
+			strategy = restartDelete
+			target, _ = restarters[strategy].target(po, owner, ownerMeta)
+		}
+		if target.kind != "Pod" {
+			po = nil
+		}
+		ids := make(map[string]string)
+		for tag := range outdated {
+			if img := images[tag]; img != nil {
+				ids[tag] = img.id
+			}
+		}
+		t := &restartTask{
+			target:     target,
+			strategy:   strategy,
+			pod:        po,
+			owner:      owner,
+			images:     outdated,
+			imageIDs:   ids,
+			trigger:    trigger,
+			receivedAt: receivedAt,
+		}
+		if target.kind == "Pod" {
+			h.enqueue(t)
+		} else if cur, ok := workloads[target]; ok {
+			mergeImages(cur, t)
+		} else {
+			workloads[target] = t
+		}
+	}
+	for _, t := range workloads {
+		h.enqueue(t)
+	}
+}
+
+// outdatedImages returns the tags used by the pod (along with the kinds of
+// containers using them) that it doesn't run the current image of. Tags that
+// couldn't be resolved to an image, and containers that have not reported the
+// image they run yet are considered outdated, except for stale checks and, for
+// the latter, for the tags that were just created.
+func outdatedImages(p *corev1.Pod, tags map[string]containerKind, images map[string]*imageInfo, created map[string]bool, staleCheck bool) map[string]containerKind {
+	out := make(map[string]containerKind)
+	for tag, kind := range tags {
+		img := images[tag]
+		if img == nil {
+			if !staleCheck {
+				out[tag] = kind
+			}
+			continue
+		}
+		if older, unknown := imageState(p, img); older || (unknown && !staleCheck && !created[tag]) {
+			out[tag] = kind
 		}
-		log.Printf("[deleted_pod] %s/%s", p.namespace, p.name)
+	}
+	return out
+}
 
-		// TODO(ahmetb) see if there's a better way of doing this: here we
-		// unregister the pod directly, because we know we just deleted it. it's
-		// faster than deletion to actually go through and come back via WATCH.
-		h.pods.del(p, tag)
+// formatImages formats the tags along with the kinds of containers using them
+// for logging.
+func formatImages(tags map[string]containerKind) string {
+	out := make([]string, 0, len(tags))
+	for tag, kind := range tags {
+		out = append(out, fmt.Sprintf("%s[%s]", tag, kind))
 	}
+	sort.Strings(out)
+	return strings.Join(out, ",")
 }
 
 // Track registers that we know the given pod exists right now.
 func (h *podDeletionHandler) Track(p *corev1.Pod) {
-	log.Printf("[track_pod] %s/%s", p.GetNamespace(), p.GetName())
-	for _, c := range p.Spec.Containers {
-		h.pods.add(pod{
-			namespace: p.Namespace,
-			name:      p.Name}, canonicalImage(c.Image))
+	logEvent("track_pod").pod(p.Namespace, p.Name).debug()
+	h.pods.set(pod{namespace: p.Namespace, name: p.Name}, podImages(p))
+}
+
+// Retrack re-indexes the images of the given pod if they were changed by an
+// update to the pod.
+func (h *podDeletionHandler) Retrack(oldPod, newPod *corev1.Pod) {
+	images := podImages(newPod)
+	if reflect.DeepEqual(podImages(oldPod), images) {
+		return
 	}
+	logEvent("retrack_pod").pod(newPod.Namespace, newPod.Name).debug()
+	h.pods.set(pod{namespace: newPod.Namespace, name: newPod.Name}, images)
 }
 
 // Untrack removes the given pod from tracking list when it no longer exists.
 func (h *podDeletionHandler) Untrack(p *corev1.Pod) {
-	log.Printf("[untrack_pod] %s/%s", p.GetNamespace(), p.GetName())
-	for _, c := range p.Spec.Containers {
-		h.pods.del(pod{
-			namespace: p.Namespace,
-			name:      p.Name}, canonicalImage(c.Image))
+	logEvent("untrack_pod").pod(p.Namespace, p.Name).debug()
+	h.pods.set(pod{namespace: p.Namespace, name: p.Name}, nil)
+}
+
+// CheckStale waits for the informer to sync and checks whether the tracked
+// pods run the images their tags currently point to, restarting or reporting
+// the ones that don't. This catches up with the images rebuilt while freshpod
+// was not running. If interval is positive, the check is repeated on a timer.
+func (h *podDeletionHandler) CheckStale(ctx context.Context, k8s kubernetes.Interface, hasSynced cache.InformerSynced, interval time.Duration) {
+	if !cache.WaitForCacheSync(ctx.Done(), hasSynced) {
+		return
+	}
+	for {
+		// pods referring to images by repo digest or ID are also indexed
+		// under those, but they are never stale with respect to them.
+		var tags []string
+		for _, ref := range h.pods.images() {
+			if isTag(ref) {
+				tags = append(tags, ref)
+			}
+		}
+		trigger := newTriggerID()
+		logEvent("stale_check").trigger(trigger).with("images", len(tags)).info()
+		h.deletePods(ctx, k8s, tags, nil, trigger, time.Time{}, true)
+		if interval <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
 	}
 }
 
-// canonicalImage adds :latest to the image tags so
-func canonicalImage(img string) string {
-	if !strings.Contains(img, ":") {
-		// TODO(ahmetb) find better ways to add :latest. currently this detection
-		// covers both "IMAGE:TAG" format and "IMAGE@sha256:DIGEST" formats.
-		return fmt.Sprintf("%s:latest", img)
+// podLister lists the pods known to the informers.
+type podLister interface {
+	List() []interface{}
+}
+
+// Resync periodically rebuilds the registry from the pods in the informer
+// stores once they have synced, and logs the drift between the two, which
+// indicates missed watch events.
+func (h *podDeletionHandler) Resync(ctx context.Context, pods podLister, hasSynced cache.InformerSynced, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if !hasSynced() {
+				continue
+			}
+			known := make(map[pod]map[string]containerKind)
+			for _, obj := range pods.List() {
+				p, ok := obj.(*corev1.Pod)
+				if !ok {
+					logEvent("unexpected_object").msg("pod store returned non-pod object: %T", obj).warn()
+					continue
+				}
+				known[pod{namespace: p.Namespace, name: p.Name}] = podImages(p)
+			}
+			added, removed := h.pods.reset(known)
+			for _, e := range added {
+				logEvent("registry_drift").pod(e.pod.namespace, e.pod.name).image(e.image).
+					with("kind", e.kind).msg("pod missing from the registry").warn()
+			}
+			for _, e := range removed {
+				logEvent("registry_drift").pod(e.pod.namespace, e.pod.name).image(e.image).
+					with("kind", e.kind).msg("stale pod in the registry").warn()
+			}
+		}
+	}
+}
+
+// podImages returns the images used by the containers of the pod (by their
+// reference in the spec, and the digest or ID of the image they run), along
+// with the kinds of containers using them. Terminating pods and pods that have
+// opted out of restarts are not restarted, so no images are returned for them,
+// and neither are the images of the containers that have opted out.
+func podImages(p *corev1.Pod) map[string]containerKind {
+	images := make(map[string]containerKind)
+	if p.DeletionTimestamp != nil || isIgnored(p.Annotations) {
+		return images
+	}
+	ignored := ignoredContainers(p)
+	// ephemeral containers are not tracked, as documented in the README:
+	// the vendored k8s.io/api predates the EphemeralContainers field of the
+	// PodSpec, and tracking them takes a client-go upgrade.
+	for _, c := range p.Spec.InitContainers {
+		if !ignored[c.Name] {
+			images[canonicalImage(c.Image)] |= initContainer
+		}
+	}
+	for _, c := range p.Spec.Containers {
+		if !ignored[c.Name] {
+			images[canonicalImage(c.Image)] |= regularContainer
+		}
+	}
+	// pods are also indexed by the image digests and IDs they report to run,
+	// so they match the image no matter how they refer to it.
+	for _, cs := range p.Status.InitContainerStatuses {
+		if ref := statusImageRef(cs.ImageID); ref != "" && !ignored[cs.Name] {
+			images[ref] |= initContainer
+		}
+	}
+	for _, cs := range p.Status.ContainerStatuses {
+		if ref := statusImageRef(cs.ImageID); ref != "" && !ignored[cs.Name] {
+			images[ref] |= regularContainer
+		}
 	}
-	return img
+	return images
 }
@@ -13,66 +13,138 @@
 // limitations under the License.
 package main
 
-import "sync"
+import (
+	"sort"
+	"strings"
+	"sync"
+)
 
 type pod struct{ name, namespace string }
 
+// containerKind is a set of the kinds of containers of a pod that use an image.
+type containerKind uint8
+
+const (
+	regularContainer containerKind = 1 << iota
+	initContainer
+)
+
+func (k containerKind) String() string {
+	var kinds []string
+	if k&regularContainer != 0 {
+		kinds = append(kinds, "container")
+	}
+	if k&initContainer != 0 {
+		kinds = append(kinds, "init_container")
+	}
+	return strings.Join(kinds, ",")
+}
+
+// registryEntry is a single image used by a pod in the registry.
+type registryEntry struct {
+	pod   pod
+	image string
+	kind  containerKind
+}
+
 type podRegistry struct {
 	mu       sync.RWMutex
-	imgToPod map[string]map[pod]struct{}
-	podToImg map[pod]map[string]struct{}
+	imgToPod map[string]map[pod]containerKind
+	podToImg map[pod]map[string]containerKind
 }
 
 func newRegistry() *podRegistry {
 	return &podRegistry{
-		imgToPod: make(map[string]map[pod]struct{}),
-		podToImg: make(map[pod]map[string]struct{}),
+		imgToPod: make(map[string]map[pod]containerKind),
+		podToImg: make(map[pod]map[string]containerKind),
 	}
 }
 
-// add registers that pod uses the specified image. It can be called multiple
-// times with different image values to register images of multiple containers
-// of the same pod.
-func (r *podRegistry) add(p pod, image string) {
+// set replaces the images registered for the pod with the specified images.
+// Passing no images unregisters the pod.
+func (r *podRegistry) set(p pod, images map[string]containerKind) {
 	r.mu.Lock()
+	r.setLocked(p, images)
+	r.mu.Unlock()
+}
 
-	if _, ok := r.imgToPod[image]; !ok {
-		r.imgToPod[image] = make(map[pod]struct{})
+func (r *podRegistry) setLocked(p pod, images map[string]containerKind) {
+	for image := range r.podToImg[p] {
+		delete(r.imgToPod[image], p)
+		if len(r.imgToPod[image]) == 0 {
+			delete(r.imgToPod, image)
+		}
 	}
+	delete(r.podToImg, p)
 
-	r.imgToPod[image][p] = struct{}{}
-	if _, ok := r.podToImg[p]; !ok {
-		r.podToImg[p] = make(map[string]struct{})
+	if len(images) == 0 {
+		return
+	}
+	r.podToImg[p] = make(map[string]containerKind, len(images))
+	for image, kind := range images {
+		if _, ok := r.imgToPod[image]; !ok {
+			r.imgToPod[image] = make(map[pod]containerKind)
+		}
+		r.imgToPod[image][p] = kind
+		r.podToImg[p][image] = kind
 	}
-	r.podToImg[p][image] = struct{}{}
-	r.mu.Unlock()
 }
 
-// del unregisters that the pod is using the specified image. It can be multiple
-// times with different images to unregister images of multiple containers of
-// the same pod.
-func (r *podRegistry) del(p pod, image string) {
+// reset replaces the contents of the registry with the specified pods and
+// their images. It returns the entries that were missing from the registry and
+// the stale entries it had.
+func (r *podRegistry) reset(pods map[pod]map[string]containerKind) (added, removed []registryEntry) {
 	r.mu.Lock()
-	delete(r.imgToPod[image], p)
-	if len(r.imgToPod[image]) == 0 {
-		delete(r.imgToPod, image)
+	defer r.mu.Unlock()
+
+	for p, images := range r.podToImg {
+		for image, kind := range images {
+			if pods[p][image] != kind {
+				removed = append(removed, registryEntry{pod: p, image: image, kind: kind})
+			}
+		}
+		if _, ok := pods[p]; !ok {
+			r.setLocked(p, nil)
+		}
 	}
-	delete(r.podToImg[p], image)
-	if len(r.podToImg[p]) == 0 {
-		delete(r.podToImg, p)
+	for p, images := range pods {
+		for image, kind := range images {
+			if r.podToImg[p][image] != kind {
+				added = append(added, registryEntry{pod: p, image: image, kind: kind})
+			}
+		}
+		r.setLocked(p, images)
 	}
-	r.mu.Unlock()
+	return added, removed
+}
+
+// get retrieves the pods running the image, along with the kinds of their
+// containers using it.
+func (r *podRegistry) get(image string) map[pod]containerKind {
+	r.mu.RLock()
+	out := make(map[pod]containerKind, len(r.imgToPod[image]))
+	for p, kind := range r.imgToPod[image] {
+		out[p] = kind
+	}
+	r.mu.RUnlock()
+	return out
+}
+
+// size returns the number of images and pods in the registry.
+func (r *podRegistry) size() (images, pods int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.imgToPod), len(r.podToImg)
 }
 
-// get retrieves list of pods running the image.
-func (r *podRegistry) get(image string) []pod {
+// images retrieves the list of images used by the registered pods.
+func (r *podRegistry) images() []string {
 	r.mu.RLock()
-	out := make([]pod, len(r.imgToPod[image]))
-	var i int
-	for p := range r.imgToPod[image] {
-		out[i] = p
-		i++
+	out := make([]string, 0, len(r.imgToPod))
+	for image := range r.imgToPod {
+		out = append(out, image)
 	}
 	r.mu.RUnlock()
+	sort.Strings(out)
 	return out
 }
@@ -0,0 +1,130 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// podWatchers runs a pod informer for each of the watched namespaces, or a
+// single one for all namespaces, and starts and stops them as the watched
+// namespaces change.
+type podWatchers struct {
+	ctx     context.Context
+	k8s     *kubernetes.Clientset
+	resync  time.Duration
+	handler *podDeletionHandler
+
+	mu       sync.Mutex
+	watchers map[string]*podWatcher
+}
+
+type podWatcher struct {
+	store      cache.Store
+	controller cache.Controller
+	stop       chan struct{}
+}
+
+func newPodWatchers(ctx context.Context, k8s *kubernetes.Clientset, resync time.Duration, handler *podDeletionHandler) *podWatchers {
+	w := &podWatchers{
+		ctx:      ctx,
+		k8s:      k8s,
+		resync:   resync,
+		handler:  handler,
+		watchers: make(map[string]*podWatcher),
+	}
+	go func() {
+		<-ctx.Done()
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		for _, pw := range w.watchers {
+			close(pw.stop)
+		}
+		w.watchers = nil
+	}()
+	return w
+}
+
+// setNamespaces starts watching the pods in the namespaces (all namespaces if
+// empty) and stops watching the others, untracking their pods.
+func (w *podWatchers) setNamespaces(namespaces []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ctx.Err() != nil {
+		return
+	}
+	if len(namespaces) == 0 {
+		namespaces = []string{corev1.NamespaceAll}
+	}
+	want := make(map[string]bool)
+	for _, ns := range namespaces {
+		want[ns] = true
+	}
+
+	// stop first, so the pods of namespaces still watched by another
+	// informer (such as when switching from all namespaces to some) are
+	// tracked again by it.
+	for ns, pw := range w.watchers {
+		if want[ns] {
+			continue
+		}
+		close(pw.stop)
+		delete(w.watchers, ns)
+		for _, obj := range pw.store.List() {
+			if p, ok := obj.(*corev1.Pod); ok {
+				w.handler.Untrack(p)
+			}
+		}
+		logEvent("namespace_unwatched").with("namespace", ns).info()
+	}
+	for ns := range want {
+		if _, ok := w.watchers[ns]; ok {
+			continue
+		}
+		store, controller := podWatchController(w.k8s, ns, w.resync, w.handler)
+		pw := &podWatcher{store: store, controller: controller, stop: make(chan struct{})}
+		w.watchers[ns] = pw
+		go controller.Run(pw.stop)
+		logEvent("namespace_watched").with("namespace", ns).info()
+	}
+}
+
+// HasSynced reports whether all the pod informers have synced.
+func (w *podWatchers) HasSynced() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, pw := range w.watchers {
+		if !pw.controller.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// List returns the pods known to the informers.
+func (w *podWatchers) List() []interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var out []interface{}
+	for _, pw := range w.watchers {
+		out = append(out, pw.store.List()...)
+	}
+	return out
+}
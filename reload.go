@@ -0,0 +1,229 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// staticConfigKeys are the keys of the config that only take effect on
+// startup. Reloads changing them keep their current values.
+var staticConfigKeys = map[string]bool{
+	"kubeconfig":              true,
+	"context":                 true,
+	"runtime":                 true,
+	"sources":                 true,
+	"nodeName":                true,
+	"dockerHost":              true,
+	"containerdAddress":       true,
+	"containerdNamespace":     true,
+	"criEndpoint":             true,
+	"criPollInterval":         true,
+	"eventTypes":              true,
+	"concurrency":             true,
+	"resyncInterval":          true,
+	"informerResync":          true,
+	"staleCheckInterval":      true,
+	"leaderElect":             true,
+	"leaderElectResourceLock": true,
+	"leaderElectNamespace":    true,
+	"leaderElectName":         true,
+	"httpAddr":                true,
+}
+
+// liveConfig holds the current config, which is replaced as a whole when it's
+// reloaded. The config it holds must not be modified.
+type liveConfig struct {
+	mu       sync.RWMutex
+	cfg      *config
+	onChange []func(*config)
+}
+
+func newLiveConfig(cfg *config) *liveConfig {
+	return &liveConfig{cfg: cfg}
+}
+
+// get returns the current config.
+func (l *liveConfig) get() *config {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cfg
+}
+
+// subscribe registers a function to call with the new config after reloads.
+func (l *liveConfig) subscribe(fn func(*config)) {
+	l.mu.Lock()
+	l.onChange = append(l.onChange, fn)
+	l.mu.Unlock()
+}
+
+func (l *liveConfig) set(cfg *config) {
+	l.mu.Lock()
+	l.cfg = cfg
+	subscribers := l.onChange
+	l.mu.Unlock()
+	for _, fn := range subscribers {
+		fn(cfg)
+	}
+}
+
+// configReloader rebuilds the config from its sources when the config file
+// should be re-read (on SIGHUP) or the ConfigMap changes, and replaces the
+// live config if the new one is valid.
+type configReloader struct {
+	sources *configSources
+	live    *liveConfig
+
+	mu sync.Mutex
+	// configMap is the YAML config in the ConfigMap, nil if there's none.
+	configMap []byte
+}
+
+// reload rebuilds the config after a change of the source, and logs the
+// changes it makes. Invalid configs are rejected, keeping the current one.
+func (r *configReloader) reload(source string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cur := r.live.get()
+	next, err := r.sources.build(r.configMap)
+	if err == nil {
+		err = next.validate()
+	}
+	if err != nil {
+		logEvent("config_rejected").with("source", source).err(err).error()
+		return
+	}
+
+	changes := 0
+	cv, nv := reflect.ValueOf(cur).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < cv.NumField(); i++ {
+		key := strings.Split(cv.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		old, new := cv.Field(i), nv.Field(i)
+		if reflect.DeepEqual(old.Interface(), new.Interface()) {
+			continue
+		}
+		if staticConfigKeys[key] {
+			logEvent("config_restart_required").with("source", source).with("key", key).
+				with("old", formatConfigValue(old)).with("new", formatConfigValue(new)).
+				msg("keeping the current value until freshpod is restarted").warn()
+			new.Set(old)
+			continue
+		}
+		logEvent("config_changed").with("source", source).with("key", key).
+			with("old", formatConfigValue(old)).with("new", formatConfigValue(new)).info()
+		changes++
+	}
+	if changes == 0 {
+		logEvent("config_unchanged").with("source", source).info()
+		return
+	}
+	r.live.set(next)
+}
+
+func formatConfigValue(v reflect.Value) string {
+	if s, ok := v.Addr().Interface().(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// reloadOnSignal re-reads the config file on SIGHUP until the context is
+// cancelled.
+func (r *configReloader) reloadOnSignal(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			r.reload("sighup")
+		}
+	}
+}
+
+// readConfigMap returns the YAML config in the ConfigMap, or nil if the
+// ConfigMap or its key doesn't exist.
+func readConfigMap(k8s kubernetes.Interface, namespace, name string) ([]byte, error) {
+	cm, err := k8s.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		logEvent("configmap_not_found").with("namespace", namespace).with("name", name).warn()
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to get configmap %s/%s", namespace, name)
+	}
+	data, ok := cm.Data[configMapKey]
+	if !ok {
+		return nil, nil
+	}
+	return []byte(data), nil
+}
+
+// watchConfigMap reloads the YAML config in the ConfigMap whenever it changes,
+// until the context is cancelled. The reloader is expected to hold the
+// content read on startup.
+func (r *configReloader) watchConfigMap(ctx context.Context, k8s *kubernetes.Clientset, namespace, name string) {
+	update := func(obj interface{}) {
+		cm, ok := obj.(*corev1.ConfigMap)
+		if !ok {
+			logEvent("unexpected_object").msg("list/watch returned non-configmap object: %T", obj).warn()
+			return
+		}
+		var data []byte
+		if v, ok := cm.Data[configMapKey]; ok {
+			data = []byte(v)
+		}
+		r.mu.Lock()
+		// the ConfigMap read on startup is delivered again by the first
+		// list, and there's nothing to reload then.
+		unchanged := bytes.Equal(data, r.configMap) && (data == nil) == (r.configMap == nil)
+		r.configMap = data
+		r.mu.Unlock()
+		if !unchanged {
+			r.reload("configmap")
+		}
+	}
+
+	lw := cache.NewListWatchFromClient(k8s.CoreV1().RESTClient(), "configmaps", namespace,
+		fields.OneTermEqualSelector("metadata.name", name))
+	_, controller := cache.NewInformer(lw, &corev1.ConfigMap{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc:    update,
+		UpdateFunc: func(_, obj interface{}) { update(obj) },
+		DeleteFunc: func(interface{}) {
+			r.mu.Lock()
+			r.configMap = nil
+			r.mu.Unlock()
+			r.reload("configmap")
+		},
+	})
+	controller.Run(ctx.Done())
+}
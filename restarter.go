@@ -0,0 +1,394 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// restartDelete restarts pods by deleting them and letting their
+	// controllers create new ones.
+	restartDelete = "delete"
+	// restartEvict restarts pods by evicting them, which respects the
+	// PodDisruptionBudgets covering them.
+	restartEvict = "evict"
+	// restartRollout restarts the pods of a Deployment, StatefulSet or
+	// DaemonSet with a rolling update of the workload.
+	restartRollout = "rollout"
+	// restartScale restarts the pods of a Deployment, StatefulSet or
+	// ReplicaSet by scaling the workload down to zero and back up.
+	restartScale = "scale"
+	// restartKill restarts the outdated containers of pods in place by
+	// stopping them with the container runtime, and letting the kubelet
+	// start them again.
+	restartKill = "kill"
+
+	// restartStrategyAnnotation selects the restart strategy of a pod (or
+	// of all the pods of a workload, when set on the workload or its pod
+	// template), overriding the restart mode of the config.
+	restartStrategyAnnotation = "freshpod.io/restart-strategy"
+
+	// scaleDownTimeout bounds the wait for the pods of a workload scaled
+	// down to go away before scaling it back up.
+	scaleDownTimeout = time.Minute * 2
+)
+
+// restarter is a strategy to restart pods.
+type restarter interface {
+	// target returns what to restart to restart the pod, which is managed
+	// by owner (nil for bare pods) whose object is ownerMeta (nil if it's of
+	// a kind freshpod doesn't know), or false if the strategy can't restart
+	// the pod.
+	target(p *corev1.Pod, owner *corev1.ObjectReference, ownerMeta metav1.Object) (workload, bool)
+	// restart restarts the target of the task. restarted is false if the
+	// target was left alone, such as a paused Deployment.
+	restart(h *podDeletionHandler, k8s kubernetes.Interface, t *restartTask) (restarted bool, err error)
+}
+
+// restarters are the restart strategies, by name.
+var restarters = map[string]restarter{
+	restartDelete:  podDeleter{},
+	restartEvict:   podEvicter{},
+	restartRollout: workloadRollout{kinds: []string{"Deployment", "StatefulSet", "DaemonSet"}},
+	restartScale:   workloadScaler{kinds: []string{"Deployment", "StatefulSet", "ReplicaSet"}},
+	restartKill:    containerKiller{},
+}
+
+// restarterNames returns the names of the restart strategies, sorted.
+func restarterNames() []string {
+	var out []string
+	for name := range restarters {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// restartStrategy returns the name of the strategy to restart the pod with:
+// the one set with the restart-strategy annotation of the pod (usually from
+// its pod template), or else of the workload managing it, or else the restart
+// mode of the config. Unknown strategies in annotations are reported and
+// ignored.
+func restartStrategy(cfg *config, p *corev1.Pod, owner metav1.Object) string {
+	objects := []metav1.Object{p}
+	if owner != nil {
+		objects = append(objects, owner)
+	}
+	for _, o := range objects {
+		name, ok := o.GetAnnotations()[restartStrategyAnnotation]
+		if !ok {
+			continue
+		}
+		if _, ok := restarters[name]; ok {
+			return name
+		}
+		logEvent("invalid_restart_strategy").pod(p.Namespace, p.Name).owner(podOwner(p)).
+			with("strategy", name).msg("ignoring the %s annotation of %s", restartStrategyAnnotation, o.GetName()).warn()
+	}
+	return cfg.RestartMode
+}
+
+func podTarget(p *corev1.Pod) workload {
+	return workload{kind: "Pod", namespace: p.Namespace, name: p.Name}
+}
+
+// ownerTarget returns the owner as the target if it's one of the kinds.
+func ownerTarget(owner *corev1.ObjectReference, kinds []string) (workload, bool) {
+	if owner == nil {
+		return workload{}, false
+	}
+	for _, kind := range kinds {
+		if owner.Kind == kind {
+			return workload{kind: owner.Kind, namespace: owner.Namespace, name: owner.Name}, true
+		}
+	}
+	return workload{}, false
+}
+
+// podDeleter deletes pods, and creates the bare pods again.
+type podDeleter struct{}
+
+func (podDeleter) target(p *corev1.Pod, owner *corev1.ObjectReference, ownerMeta metav1.Object) (workload, bool) {
+	return podTarget(p), true
+}
+
+func (podDeleter) restart(h *podDeletionHandler, k8s kubernetes.Interface, t *restartTask) (restarted bool, err error) {
+	p := pod{namespace: t.target.namespace, name: t.target.name}
+	logEvent("deleting_pod").pod(p.namespace, p.name).owner(podOwner(t.pod)).trigger(t.trigger).
+		with("images", formatImages(t.images)).info()
+	err = k8s.CoreV1().Pods(p.namespace).Delete(p.name, h.deleteOptions())
+	if apierrors.IsNotFound(err) {
+		// either deleted by someone else, or by an earlier attempt of this
+		// restart that failed to recreate the pod afterwards.
+		logEvent("pod_gone").pod(p.namespace, p.name).trigger(t.trigger).info()
+	} else if err != nil {
+		podDeletionsTotal.WithLabelValues(p.namespace, "failed").Inc()
+		return false, errors.Wrap(err, "failed to delete pod")
+	} else {
+		restarted = true
+		t.deleted = true
+		podDeletionsTotal.WithLabelValues(p.namespace, "deleted").Inc()
+		logEvent("deleted_pod").pod(p.namespace, p.name).owner(podOwner(t.pod)).trigger(t.trigger).info()
+	}
+	return h.podRemoved(k8s, t, restarted)
+}
+
+// podEvicter evicts pods with the Eviction API, so the API server refuses to
+// disrupt more pods than their PodDisruptionBudgets allow. Blocked evictions
+// are retried with backoff, and the pods are deleted once they have been
+// blocked for the eviction timeout of the config. The bare pods are created
+// again.
+type podEvicter struct{}
+
+func (podEvicter) target(p *corev1.Pod, owner *corev1.ObjectReference, ownerMeta metav1.Object) (workload, bool) {
+	return podTarget(p), true
+}
+
+func (podEvicter) restart(h *podDeletionHandler, k8s kubernetes.Interface, t *restartTask) (restarted bool, err error) {
+	p := pod{namespace: t.target.namespace, name: t.target.name}
+	timeout := h.config.get().EvictionTimeout.Duration
+	if !t.blockedSince.IsZero() && timeout > 0 && time.Since(t.blockedSince) >= timeout {
+		blockedFor := time.Since(t.blockedSince).Round(time.Second)
+		logEvent("eviction_timed_out").pod(p.namespace, p.name).owner(podOwner(t.pod)).trigger(t.trigger).
+			with("blocked_for", blockedFor).msg("deleting the pod instead").warn()
+		h.recordEvent(t, corev1.EventTypeWarning, reasonEvictionBlocked,
+			"Deleting pod %s: its eviction was blocked for %s", p.name, blockedFor)
+		t.strategy = restartDelete
+		return restarters[restartDelete].restart(h, k8s, t)
+	}
+
+	logEvent("evicting_pod").pod(p.namespace, p.name).owner(podOwner(t.pod)).trigger(t.trigger).
+		with("images", formatImages(t.images)).info()
+	err = k8s.CoreV1().Pods(p.namespace).Evict(&policyv1beta1.Eviction{
+		ObjectMeta:    metav1.ObjectMeta{Namespace: p.namespace, Name: p.name},
+		DeleteOptions: h.deleteOptions(),
+	})
+	if apierrors.IsTooManyRequests(err) {
+		// the API server refuses evictions that would disrupt more pods
+		// than a PodDisruptionBudget allows, until enough of them are
+		// ready again.
+		evictionsBlockedTotal.WithLabelValues(p.namespace).Inc()
+		if t.blockedSince.IsZero() {
+			t.blockedSince = time.Now()
+			blockedEvictions.WithLabelValues(p.namespace).Inc()
+			logEvent("eviction_blocked").pod(p.namespace, p.name).owner(podOwner(t.pod)).trigger(t.trigger).
+				err(err).warn()
+			h.recordEvent(t, corev1.EventTypeWarning, reasonEvictionBlocked,
+				"Eviction of pod %s blocked: %v", p.name, err)
+		} else {
+			logEvent("eviction_still_blocked").pod(p.namespace, p.name).owner(podOwner(t.pod)).trigger(t.trigger).
+				with("blocked_for", time.Since(t.blockedSince).Round(time.Second)).err(err).warn()
+		}
+		return false, evictionBlockedError{errors.Wrap(err, "eviction blocked")}
+	} else if apierrors.IsNotFound(err) {
+		logEvent("pod_gone").pod(p.namespace, p.name).trigger(t.trigger).info()
+	} else if err != nil {
+		podDeletionsTotal.WithLabelValues(p.namespace, "failed").Inc()
+		return false, errors.Wrap(err, "failed to evict pod")
+	} else {
+		restarted = true
+		t.deleted = true
+		podDeletionsTotal.WithLabelValues(p.namespace, "deleted").Inc()
+		rec := logEvent("evicted_pod").pod(p.namespace, p.name).owner(podOwner(t.pod)).trigger(t.trigger)
+		if !t.blockedSince.IsZero() {
+			rec = rec.with("blocked_for", time.Since(t.blockedSince).Round(time.Second))
+		}
+		rec.info()
+	}
+	return h.podRemoved(k8s, t, restarted)
+}
+
+// evictionBlockedError is returned by the evictions refused by the API server
+// because of a PodDisruptionBudget. They are retried until the eviction
+// timeout expires, rather than a fixed number of times.
+type evictionBlockedError struct{ error }
+
+// isEvictionBlocked reports whether the restart failed because the eviction
+// of the pod was blocked.
+func isEvictionBlocked(err error) bool {
+	_, ok := errors.Cause(err).(evictionBlockedError)
+	return ok
+}
+
+// podRemoved untracks the pod of the task that was just deleted, and creates
+// it again if it's a bare pod that freshpod deleted. Bare pods deleted by
+// someone else in the meantime are left alone.
+func (h *podDeletionHandler) podRemoved(k8s kubernetes.Interface, t *restartTask, restarted bool) (bool, error) {
+	// TODO(ahmetb) see if there's a better way of doing this: here we
+	// unregister the pod directly, because we know we just deleted it. it's
+	// faster than deletion to actually go through and come back via WATCH.
+	h.pods.set(pod{namespace: t.target.namespace, name: t.target.name}, nil)
+
+	if t.deleted && t.pod != nil && isBarePod(t.pod) {
+		// nothing will bring this pod back, so we create it again.
+		return true, recreatePod(k8s.CoreV1(), t.pod)
+	}
+	return restarted, nil
+}
+
+// workloadRollout restarts the pods of a workload with a rolling update.
+type workloadRollout struct{ kinds []string }
+
+func (r workloadRollout) target(p *corev1.Pod, owner *corev1.ObjectReference, ownerMeta metav1.Object) (workload, bool) {
+	if ownerMeta != nil && !canRollOut(ownerMeta) {
+		return workload{}, false
+	}
+	return ownerTarget(owner, r.kinds)
+}
+
+func (workloadRollout) restart(h *podDeletionHandler, k8s kubernetes.Interface, t *restartTask) (bool, error) {
+	return rolloutWorkload(k8s.AppsV1(), t.target)
+}
+
+// workloadScaler restarts the pods of a workload by scaling it down and up.
+// Unlike a rollout, all the pods of the workload are down for a moment.
+type workloadScaler struct{ kinds []string }
+
+func (s workloadScaler) target(p *corev1.Pod, owner *corev1.ObjectReference, ownerMeta metav1.Object) (workload, bool) {
+	return ownerTarget(owner, s.kinds)
+}
+
+func (workloadScaler) restart(h *podDeletionHandler, k8s kubernetes.Interface, t *restartTask) (bool, error) {
+	return scaleWorkload(k8s.AppsV1(), t.target, scaleDownTimeout)
+}
+
+// containerStopper stops containers with the container runtime.
+type containerStopper interface {
+	// stopContainer stops the container with the runtime ID, and kills it
+	// if it's still running after the timeout.
+	stopContainer(ctx context.Context, id string, timeout time.Duration) error
+}
+
+// containerStopperFactory creates the container stopper of a container
+// runtime from the config.
+type containerStopperFactory func(ctx context.Context, cfg *config) (containerStopper, error)
+
+// containerStoppers are the container stoppers of the container runtimes, by
+// runtime.
+var containerStoppers = map[string]containerStopperFactory{
+	runtimeDocker:     newDockerContainers,
+	runtimeContainerd: newContainerdContainers,
+	runtimeCRI:        newCRIContainers,
+}
+
+// newContainerStopper creates the container stopper of the runtime of the
+// config.
+func newContainerStopper(ctx context.Context, cfg *config) (containerStopper, error) {
+	factory, ok := containerStoppers[cfg.Runtime]
+	if !ok {
+		return nil, errors.Errorf("unknown runtime %q", cfg.Runtime)
+	}
+	return factory(ctx, cfg)
+}
+
+// containerKiller restarts the containers of pods running an outdated image in
+// place: it stops them with the container runtime and the kubelet starts them
+// again with the current image of their tag, without rescheduling the pod.
+// It only works for pods on the node freshpod talks to the runtime of, and
+// whose restart policy restarts stopped containers. Other pods are deleted.
+type containerKiller struct{}
+
+func (containerKiller) target(p *corev1.Pod, owner *corev1.ObjectReference, ownerMeta metav1.Object) (workload, bool) {
+	return podTarget(p), true
+}
+
+func (containerKiller) restart(h *podDeletionHandler, k8s kubernetes.Interface, t *restartTask) (bool, error) {
+	p, err := k8s.CoreV1().Pods(t.target.namespace).Get(t.target.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		logEvent("pod_gone").pod(t.target.namespace, t.target.name).trigger(t.trigger).info()
+		h.pods.set(pod{namespace: t.target.namespace, name: t.target.name}, nil)
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "failed to get pod")
+	}
+
+	ids := outdatedContainerIDs(p, t.images)
+	cfg := h.config.get()
+	var reason string
+	switch {
+	case h.containers == nil:
+		reason = "no container runtime configured"
+	case p.Spec.RestartPolicy == corev1.RestartPolicyNever:
+		reason = "pod never restarts its containers"
+	case cfg.NodeName != "" && p.Spec.NodeName != cfg.NodeName:
+		reason = "pod runs on node " + p.Spec.NodeName
+	case len(ids) == 0:
+		reason = "no running container with an outdated image"
+	}
+	if reason != "" {
+		logEvent("kill_unsupported").pod(p.Namespace, p.Name).owner(podOwner(p)).trigger(t.trigger).
+			with("reason", reason).msg("deleting the pod instead").info()
+		t.strategy = restartDelete
+		return restarters[restartDelete].restart(h, k8s, t)
+	}
+
+	timeout := time.Duration(corev1.DefaultTerminationGracePeriodSeconds) * time.Second
+	if cfg.GracePeriod >= 0 {
+		timeout = time.Duration(cfg.GracePeriod) * time.Second
+	} else if p.Spec.TerminationGracePeriodSeconds != nil {
+		timeout = time.Duration(*p.Spec.TerminationGracePeriodSeconds) * time.Second
+	}
+	names := make([]string, 0, len(ids))
+	for name := range ids {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		logEvent("stopping_container").pod(p.Namespace, p.Name).owner(podOwner(p)).trigger(t.trigger).
+			with("container", name).info()
+		ctx, cancel := context.WithTimeout(h.work, timeout+time.Second*30)
+		err := h.containers.stopContainer(ctx, ids[name], timeout)
+		cancel()
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to stop container %s", name)
+		}
+		logEvent("stopped_container").pod(p.Namespace, p.Name).owner(podOwner(p)).trigger(t.trigger).
+			with("container", name).info()
+	}
+	return true, nil
+}
+
+// outdatedContainerIDs returns the runtime IDs of the running regular
+// containers of the pod using the outdated tags, by container name.
+func outdatedContainerIDs(p *corev1.Pod, tags map[string]containerKind) map[string]string {
+	ignored := ignoredContainers(p)
+	outdated := make(map[string]bool)
+	for _, c := range p.Spec.Containers {
+		if tags[canonicalImage(c.Image)]&regularContainer != 0 && !ignored[c.Name] {
+			outdated[c.Name] = true
+		}
+	}
+	out := make(map[string]string)
+	for _, cs := range p.Status.ContainerStatuses {
+		if !outdated[cs.Name] || cs.State.Running == nil {
+			continue
+		}
+		// the IDs are reported as <runtime>://<id>, such as docker://0123.
+		if i := strings.Index(cs.ContainerID, "://"); i >= 0 && i+3 < len(cs.ContainerID) {
+			out[cs.Name] = cs.ContainerID[i+3:]
+		}
+	}
+	return out
+}
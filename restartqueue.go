@@ -0,0 +1,274 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// maxRestartRetries is how many times a restart failing with a transient
+	// error is retried before giving up.
+	maxRestartRetries = 5
+
+	minRestartBackoff = time.Second
+	maxRestartBackoff = time.Minute
+)
+
+// restartTask describes the restart of a pod or a workload managing pods.
+type restartTask struct {
+	target workload
+	// strategy is the name of the restarter restarting the target.
+	strategy string
+	// pod is the pod to restart as last seen, if the target is a pod.
+	pod *corev1.Pod
+	// owner is the workload managing the pod, if known. For workloads
+	// restarted as a whole, such as with a rollout, it's the workload
+	// itself.
+	owner *corev1.ObjectReference
+	// images are the outdated images that triggered the restart.
+	images map[string]containerKind
+	// imageIDs are the IDs of the images the outdated tags point to, if they
+	// could be resolved.
+	imageIDs map[string]string
+	// trigger identifies the batch of tag events (or the stale check) that
+	// requested the restart in the logs.
+	trigger string
+	// receivedAt is when the earliest tag event triggering the restart was
+	// received. It's zero for restarts not triggered by tag events.
+	receivedAt time.Time
+	// blockedSince is when the eviction of the pod was first blocked by a
+	// PodDisruptionBudget, if it was.
+	blockedSince time.Time
+	// deleted is set once an attempt of the restart has deleted the pod,
+	// so the retries of a failed recreation of a bare pod still create it.
+	deleted bool
+}
+
+func newRestartQueue() workqueue.RateLimitingInterface {
+	return workqueue.NewNamedRateLimitingQueue(
+		workqueue.NewItemExponentialFailureRateLimiter(minRestartBackoff, maxRestartBackoff),
+		"restarts")
+}
+
+// enqueue schedules the restart of the task's target. Restarts of a target
+// that is already waiting in the queue are merged into one.
+func (h *podDeletionHandler) enqueue(t *restartTask) {
+	if h.queue.ShuttingDown() {
+		logEvent("restart_dropped").target(t.target).trigger(t.trigger).
+			with("images", formatImages(t.images)).msg("shutting down").warn()
+		return
+	}
+	h.tasksMu.Lock()
+	if cur, ok := h.tasks[t.target]; ok {
+		mergeImages(t, cur)
+		if t.pod == nil {
+			t.pod = cur.pod
+		}
+		if t.owner == nil {
+			t.owner = cur.owner
+		}
+		if t.receivedAt.IsZero() || (!cur.receivedAt.IsZero() && cur.receivedAt.Before(t.receivedAt)) {
+			t.receivedAt = cur.receivedAt
+		}
+		t.blockedSince = cur.blockedSince
+		t.deleted = t.deleted || cur.deleted
+		// the restart was first requested by the queued task.
+		t.trigger = cur.trigger
+	}
+	h.tasks[t.target] = t
+	h.tasksMu.Unlock()
+	h.queue.Add(t.target)
+}
+
+// runWorker processes the restarts in the queue until it's shut down.
+func (h *podDeletionHandler) runWorker(k8s kubernetes.Interface) {
+	for h.processNextTask(k8s) {
+	}
+}
+
+func (h *podDeletionHandler) processNextTask(k8s kubernetes.Interface) bool {
+	item, shutdown := h.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer h.queue.Done(item)
+	target := item.(workload)
+
+	h.tasksMu.Lock()
+	t, ok := h.tasks[target]
+	delete(h.tasks, target)
+	h.tasksMu.Unlock()
+	if !ok {
+		h.queue.Forget(item)
+		return true
+	}
+
+	h.health.processing(target)
+	restarted, err := h.restart(k8s, t)
+	h.health.processed(target)
+	if err == nil {
+		h.queue.Forget(item)
+		unblocked(t)
+		if !restarted {
+			// the target was left alone, such as a pod already gone or a
+			// paused Deployment.
+			logEvent("restart_skipped").target(target).trigger(t.trigger).
+				with("images", formatImages(t.images)).info()
+			observeRestart(t, "skipped")
+			return true
+		}
+		h.recordRestart(t)
+		logEvent("restart_succeeded").target(target).trigger(t.trigger).
+			with("images", formatImages(t.images)).info()
+		observeRestart(t, "succeeded")
+		return true
+	}
+
+	attempts := h.queue.NumRequeues(item) + 1
+	// blocked evictions are retried until the eviction timeout expires, and
+	// report the retries themselves.
+	blocked := isEvictionBlocked(err)
+	retry := blocked || (isTransient(err) && attempts <= maxRestartRetries)
+	if retry && h.queue.ShuttingDown() {
+		// the queue drops the items added once it's shut down.
+		err = errors.Wrap(err, "not retrying while shutting down")
+	} else if retry {
+		if !blocked {
+			logEvent("restart_retrying").target(target).trigger(t.trigger).
+				with("attempt", attempts).err(err).warn()
+		}
+		restartRetriesTotal.WithLabelValues(target.kind, target.namespace).Inc()
+		h.tasksMu.Lock()
+		if cur, ok := h.tasks[target]; ok {
+			// a newer restart was requested in the meantime, it will also
+			// cover the images of this one.
+			mergeImages(cur, t)
+			cur.blockedSince = t.blockedSince
+			cur.deleted = cur.deleted || t.deleted
+		} else {
+			h.tasks[target] = t
+		}
+		h.tasksMu.Unlock()
+		h.queue.AddRateLimited(item)
+		return true
+	}
+
+	h.queue.Forget(item)
+	unblocked(t)
+	h.recordRestartFailure(t, err)
+	logEvent("restart_failed").target(target).trigger(t.trigger).
+		with("attempts", attempts).with("images", formatImages(t.images)).err(err).error()
+	observeRestart(t, "failed")
+	return true
+}
+
+// abandonRestarts reports the restarts left once the queue is shut down, such
+// as the ones waiting to be retried, as failed with the error, and returns how
+// many there were.
+func (h *podDeletionHandler) abandonRestarts(err error) int {
+	h.tasksMu.Lock()
+	tasks := h.tasks
+	h.tasks = make(map[workload]*restartTask)
+	h.tasksMu.Unlock()
+	for target, t := range tasks {
+		unblocked(t)
+		h.recordRestartFailure(t, err)
+		logEvent("restart_abandoned").target(target).trigger(t.trigger).
+			with("images", formatImages(t.images)).err(err).error()
+		observeRestart(t, "abandoned")
+	}
+	return len(tasks)
+}
+
+// mergeImages adds the images of the task from to the task to. The image IDs
+// already in to are more recent, so they are kept.
+func mergeImages(to, from *restartTask) {
+	for tag, kind := range from.images {
+		to.images[tag] |= kind
+	}
+	for tag, id := range from.imageIDs {
+		if _, ok := to.imageIDs[tag]; !ok {
+			to.imageIDs[tag] = id
+		}
+	}
+}
+
+// unblocked updates the metrics once the restart of the task, whose eviction
+// might have been blocked, is over.
+func unblocked(t *restartTask) {
+	if !t.blockedSince.IsZero() {
+		blockedEvictions.WithLabelValues(t.target.namespace).Dec()
+	}
+}
+
+// observeRestart records the final result of the restart in the metrics.
+func observeRestart(t *restartTask, result string) {
+	restartsTotal.WithLabelValues(t.target.kind, t.target.namespace, result).Inc()
+	if !t.receivedAt.IsZero() {
+		restartLatency.Observe(time.Since(t.receivedAt).Seconds())
+	}
+}
+
+// restart restarts the target of the task with the restarter of its
+// strategy. restarted is false if the target was left alone, such as a paused
+// Deployment.
+func (h *podDeletionHandler) restart(k8s kubernetes.Interface, t *restartTask) (restarted bool, err error) {
+	r, ok := restarters[t.strategy]
+	if !ok {
+		return false, errors.Errorf("unknown restart strategy %q", t.strategy)
+	}
+	return r.restart(h, k8s, t)
+}
+
+// deleteOptions returns the options to delete pods with, or nil for the
+// defaults.
+func (h *podDeletionHandler) deleteOptions() *metav1.DeleteOptions {
+	grace := h.config.get().GracePeriod
+	if grace < 0 {
+		return nil
+	}
+	return &metav1.DeleteOptions{GracePeriodSeconds: &grace}
+}
+
+// permanentError is returned by the restarts that no retry can fix, such as
+// the restart of a workload of a kind the strategy doesn't support.
+type permanentError struct{ error }
+
+// isTransient reports whether the operation failing with the error is worth
+// retrying. Errors not coming from the API server (such as connection errors)
+// are considered transient, unless they're permanent errors.
+func isTransient(err error) bool {
+	err = errors.Cause(err)
+	if _, ok := err.(permanentError); ok {
+		return false
+	}
+	if _, ok := err.(apierrors.APIStatus); !ok {
+		return true
+	}
+	return apierrors.IsConflict(err) ||
+		apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsInternalError(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsUnexpectedServerError(err)
+}
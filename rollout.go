@@ -0,0 +1,272 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	appsv1typed "k8s.io/client-go/kubernetes/typed/apps/v1"
+)
+
+const (
+	// restartedAtAnnotation is set on the pod template of the workloads
+	// restarted with a rolling update. Changing its value is what triggers
+	// the rollout.
+	restartedAtAnnotation = "freshpod.io/restarted-at"
+	// scaledDownFromAnnotation holds the replicas of the workloads being
+	// restarted by scaling them down and up, while they are scaled down.
+	scaledDownFromAnnotation = "freshpod.io/scaled-down-from"
+)
+
+// workload identifies a pod, or a controller managing pods.
+type workload struct{ kind, namespace, name string }
+
+func (w workload) String() string {
+	return w.kind + "/" + w.namespace + "/" + w.name
+}
+
+// podOwner returns the controller of the pod, such as "ReplicaSet/web-5d8f7",
+// or an empty string if the pod is unknown or has no controller.
+func podOwner(p *corev1.Pod) string {
+	if p == nil {
+		return ""
+	}
+	ref := metav1.GetControllerOf(p)
+	if ref == nil {
+		return ""
+	}
+	return ref.Kind + "/" + ref.Name
+}
+
+// ownerOf returns a reference to the workload managing the pod: its
+// controller, or the Deployment managing it if its controller is a ReplicaSet
+// managed by a Deployment. It returns nil for bare pods.
+func ownerOf(apps appsv1typed.AppsV1Interface, p *corev1.Pod) (*corev1.ObjectReference, error) {
+	ref := metav1.GetControllerOf(p)
+	if ref == nil {
+		return nil, nil
+	}
+	owner := controllerReference(p.Namespace, ref)
+	if ref.Kind != "ReplicaSet" {
+		return owner, nil
+	}
+	rs, err := apps.ReplicaSets(p.Namespace).Get(ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return owner, errors.Wrapf(err, "failed to get replicaset %s/%s", p.Namespace, ref.Name)
+	}
+	if ref = metav1.GetControllerOf(rs); ref != nil && ref.Kind == "Deployment" {
+		return controllerReference(p.Namespace, ref), nil
+	}
+	return owner, nil
+}
+
+func controllerReference(namespace string, ref *metav1.OwnerReference) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: ref.APIVersion,
+		Kind:       ref.Kind,
+		Namespace:  namespace,
+		Name:       ref.Name,
+		UID:        ref.UID,
+	}
+}
+
+// rolloutWorkload triggers a rolling update of the Deployment, StatefulSet or
+// DaemonSet by patching an annotation into its pod template, so the rollout
+// honors the update strategy of the workload, such as the
+// maxUnavailable/maxSurge settings of a Deployment. Paused Deployments are
+// reported and skipped, in which case restarted is false.
+func rolloutWorkload(apps appsv1typed.AppsV1Interface, w workload) (restarted bool, err error) {
+	switch w.kind {
+	case "Deployment":
+		d, err := apps.Deployments(w.namespace).Get(w.name, metav1.GetOptions{})
+		if err != nil {
+			return false, errors.Wrap(err, "failed to get deployment")
+		}
+		if d.Spec.Paused {
+			logEvent("skip_paused_deployment").target(w).info()
+			return false, nil
+		}
+	case "StatefulSet":
+		ss, err := apps.StatefulSets(w.namespace).Get(w.name, metav1.GetOptions{})
+		if err != nil {
+			return false, errors.Wrap(err, "failed to get statefulset")
+		}
+		if !canRollOut(ss) {
+			return false, permanentError{errors.New("statefulset with the OnDelete update strategy can't be rolled out")}
+		}
+	case "DaemonSet":
+		ds, err := apps.DaemonSets(w.namespace).Get(w.name, metav1.GetOptions{})
+		if err != nil {
+			return false, errors.Wrap(err, "failed to get daemonset")
+		}
+		if !canRollOut(ds) {
+			return false, permanentError{errors.New("daemonset with the OnDelete update strategy can't be rolled out")}
+		}
+	default:
+		return false, permanentError{errors.Errorf("can't roll out a %s", w.kind)}
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{
+						restartedAtAnnotation: time.Now().Format(time.RFC3339Nano),
+					}}}}})
+	if err != nil {
+		return false, errors.Wrap(err, "failed to build patch")
+	}
+
+	logEvent("restarting_workload").target(w).info()
+	if err := patchWorkload(apps, w, patch); err != nil {
+		return false, err
+	}
+	logEvent("restarted_workload").target(w).info()
+	return true, nil
+}
+
+// scaleWorkload restarts the pods of the Deployment, StatefulSet or
+// ReplicaSet by scaling it down to zero replicas, waiting up to the timeout
+// for its pods to go away, and scaling it back up. The replicas to scale back
+// up to are kept in an annotation of the workload meanwhile, so a restart
+// interrupted halfway is resumed by its next attempt. Workloads scaled to
+// zero are skipped, in which case restarted is false.
+func scaleWorkload(apps appsv1typed.AppsV1Interface, w workload, timeout time.Duration) (restarted bool, err error) {
+	replicas, _, annotations, err := workloadReplicas(apps, w)
+	if err != nil {
+		return false, err
+	}
+	if v, ok := annotations[scaledDownFromAnnotation]; ok {
+		n, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return false, permanentError{errors.Wrapf(err, "invalid %s annotation", scaledDownFromAnnotation)}
+		}
+		replicas = int32(n)
+	}
+	if replicas == 0 {
+		logEvent("skip_scaled_down_workload").target(w).info()
+		return false, nil
+	}
+
+	scale := func(replicas int32, annotation interface{}) error {
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]interface{}{scaledDownFromAnnotation: annotation}},
+			"spec": map[string]interface{}{"replicas": replicas}})
+		if err != nil {
+			return errors.Wrap(err, "failed to build patch")
+		}
+		return patchWorkload(apps, w, patch)
+	}
+
+	logEvent("scaling_down_workload").target(w).with("replicas", replicas).info()
+	if err := scale(0, strconv.Itoa(int(replicas))); err != nil {
+		return false, err
+	}
+	waitErr := wait.PollImmediate(time.Second, timeout, func() (bool, error) {
+		_, current, _, err := workloadReplicas(apps, w)
+		return err == nil && current == 0, nil
+	})
+	// the workload is scaled back up even if its pods didn't all go away,
+	// rather than leaving it down.
+	logEvent("scaling_up_workload").target(w).with("replicas", replicas).info()
+	if err := scale(replicas, nil); err != nil {
+		return false, err
+	}
+	if waitErr != nil {
+		// retrying would scale the workload down again.
+		logEvent("scale_down_timed_out").target(w).with("timeout", timeout).
+			msg("scaled back up before all the pods terminated").warn()
+		return true, nil
+	}
+	logEvent("restarted_workload").target(w).info()
+	return true, nil
+}
+
+// canRollOut reports whether the pods of the workload are replaced when its
+// pod template changes, which isn't the case of the StatefulSets and
+// DaemonSets using the OnDelete update strategy.
+func canRollOut(meta metav1.Object) bool {
+	switch o := meta.(type) {
+	case *appsv1.StatefulSet:
+		return o.Spec.UpdateStrategy.Type != appsv1.OnDeleteStatefulSetStrategyType
+	case *appsv1.DaemonSet:
+		return o.Spec.UpdateStrategy.Type != appsv1.OnDeleteDaemonSetStrategyType
+	}
+	return true
+}
+
+// workloadReplicas returns the desired and current number of replicas of the
+// Deployment, StatefulSet or ReplicaSet, along with its annotations.
+func workloadReplicas(apps appsv1typed.AppsV1Interface, w workload) (desired, current int32, annotations map[string]string, err error) {
+	var spec *int32
+	switch w.kind {
+	case "Deployment":
+		d, err := apps.Deployments(w.namespace).Get(w.name, metav1.GetOptions{})
+		if err != nil {
+			return 0, 0, nil, errors.Wrap(err, "failed to get deployment")
+		}
+		spec, current, annotations = d.Spec.Replicas, d.Status.Replicas, d.Annotations
+	case "StatefulSet":
+		ss, err := apps.StatefulSets(w.namespace).Get(w.name, metav1.GetOptions{})
+		if err != nil {
+			return 0, 0, nil, errors.Wrap(err, "failed to get statefulset")
+		}
+		spec, current, annotations = ss.Spec.Replicas, ss.Status.Replicas, ss.Annotations
+	case "ReplicaSet":
+		rs, err := apps.ReplicaSets(w.namespace).Get(w.name, metav1.GetOptions{})
+		if err != nil {
+			return 0, 0, nil, errors.Wrap(err, "failed to get replicaset")
+		}
+		spec, current, annotations = rs.Spec.Replicas, rs.Status.Replicas, rs.Annotations
+	default:
+		return 0, 0, nil, permanentError{errors.Errorf("can't scale a %s", w.kind)}
+	}
+	// the replicas default to 1.
+	desired = 1
+	if spec != nil {
+		desired = *spec
+	}
+	return desired, current, annotations, nil
+}
+
+// patchWorkload applies the strategic merge patch to the workload.
+func patchWorkload(apps appsv1typed.AppsV1Interface, w workload, patch []byte) error {
+	var err error
+	switch w.kind {
+	case "Deployment":
+		_, err = apps.Deployments(w.namespace).Patch(w.name, types.StrategicMergePatchType, patch)
+	case "StatefulSet":
+		_, err = apps.StatefulSets(w.namespace).Patch(w.name, types.StrategicMergePatchType, patch)
+	case "DaemonSet":
+		_, err = apps.DaemonSets(w.namespace).Patch(w.name, types.StrategicMergePatchType, patch)
+	case "ReplicaSet":
+		_, err = apps.ReplicaSets(w.namespace).Patch(w.name, types.StrategicMergePatchType, patch)
+	default:
+		return permanentError{errors.Errorf("can't patch a %s", w.kind)}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to patch %s", strings.ToLower(w.kind))
+	}
+	return nil
+}
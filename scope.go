@@ -0,0 +1,164 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// ignoreAnnotation opts a pod (or all the pods of a workload, when set on
+	// the workload or its pod template) out of restarts when set to "true".
+	ignoreAnnotation = "freshpod.io/ignore"
+	// ignoreContainersAnnotation lists the comma-separated names of the
+	// containers of a pod (such as service mesh sidecars) whose images don't
+	// cause restarts.
+	ignoreContainersAnnotation = "freshpod.io/ignore-containers"
+)
+
+// isIgnored reports whether the object has opted out of restarts with the
+// ignore annotation.
+func isIgnored(annotations map[string]string) bool {
+	v, _ := strconv.ParseBool(annotations[ignoreAnnotation])
+	return v
+}
+
+// ignoredContainers returns the names of the containers of the pod that have
+// opted out of restarts with the ignore-containers annotation.
+func ignoredContainers(p *corev1.Pod) map[string]bool {
+	out := make(map[string]bool)
+	for _, name := range strings.Split(p.Annotations[ignoreContainersAnnotation], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			out[name] = true
+		}
+	}
+	return out
+}
+
+// podScope decides whether freshpod may restart pods, based on the excluded
+// namespaces and the namespace and pod selectors of a config, and on the
+// ignore annotation of the workloads managing the pods.
+type podScope struct {
+	k8s               kubernetes.Interface
+	excluded          map[string]bool
+	namespaceSelector labels.Selector
+	podSelector       labels.Selector
+
+	// namespaceLabels caches the labels of the namespaces looked up.
+	namespaceLabels map[string]labels.Set
+}
+
+func newPodScope(k8s kubernetes.Interface, cfg *config) (*podScope, error) {
+	s := &podScope{
+		k8s:             k8s,
+		excluded:        make(map[string]bool),
+		namespaceLabels: make(map[string]labels.Set),
+	}
+	for _, ns := range cfg.ExcludeNamespaces {
+		s.excluded[ns] = true
+	}
+	var err error
+	if s.namespaceSelector, err = labels.Parse(cfg.NamespaceSelector); err != nil {
+		return nil, errors.Wrap(err, "invalid namespace selector")
+	}
+	if s.podSelector, err = labels.Parse(cfg.PodSelector); err != nil {
+		return nil, errors.Wrap(err, "invalid pod selector")
+	}
+	return s, nil
+}
+
+// namespaceExcluded returns why the pods in the namespace may not be
+// restarted, or an empty string if they may.
+func (s *podScope) namespaceExcluded(namespace string) (string, error) {
+	if s.excluded[namespace] {
+		return "excluded namespace", nil
+	}
+	if s.namespaceSelector.Empty() {
+		return "", nil
+	}
+	set, ok := s.namespaceLabels[namespace]
+	if !ok {
+		ns, err := s.k8s.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to get namespace %s", namespace)
+		}
+		set = labels.Set(ns.Labels)
+		s.namespaceLabels[namespace] = set
+	}
+	if !s.namespaceSelector.Matches(set) {
+		return "namespace not matching the namespace selector", nil
+	}
+	return "", nil
+}
+
+// podExcluded returns why the pod may not be restarted, or an empty string if
+// it may.
+func (s *podScope) podExcluded(p *corev1.Pod) string {
+	if isIgnored(p.Annotations) {
+		return "pod annotated with " + ignoreAnnotation
+	}
+	if !s.podSelector.Matches(labels.Set(p.Labels)) {
+		return "pod not matching the pod selector"
+	}
+	return ""
+}
+
+// ownerExcluded returns why the pods of the workload, whose metadata is meta,
+// may not be restarted, or an empty string if they may.
+func (s *podScope) ownerExcluded(owner *corev1.ObjectReference, meta metav1.Object) string {
+	if owner == nil || meta == nil {
+		// the pod template annotations of other workloads still apply.
+		return ""
+	}
+	if isIgnored(meta.GetAnnotations()) {
+		return owner.Kind + " annotated with " + ignoreAnnotation
+	}
+	return ""
+}
+
+// workloadMeta returns the metadata of the workload managing pods, or nil if
+// there's none or it's of a kind freshpod doesn't know.
+func workloadMeta(k8s kubernetes.Interface, owner *corev1.ObjectReference) (metav1.Object, error) {
+	if owner == nil {
+		return nil, nil
+	}
+	var meta metav1.Object
+	var err error
+	apps := k8s.AppsV1()
+	switch owner.Kind {
+	case "Deployment":
+		meta, err = apps.Deployments(owner.Namespace).Get(owner.Name, metav1.GetOptions{})
+	case "ReplicaSet":
+		meta, err = apps.ReplicaSets(owner.Namespace).Get(owner.Name, metav1.GetOptions{})
+	case "StatefulSet":
+		meta, err = apps.StatefulSets(owner.Namespace).Get(owner.Name, metav1.GetOptions{})
+	case "DaemonSet":
+		meta, err = apps.DaemonSets(owner.Namespace).Get(owner.Name, metav1.GetOptions{})
+	case "Job":
+		meta, err = k8s.BatchV1().Jobs(owner.Namespace).Get(owner.Name, metav1.GetOptions{})
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s %s/%s", strings.ToLower(owner.Kind), owner.Namespace, owner.Name)
+	}
+	return meta, nil
+}